@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// checksumCacheEntry is the cached checksum and signature status of a file
+type checksumCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Type    string `json:"type"`
+	Sum     string `json:"sum"`
+	Signed  *bool  `json:"signed,omitempty"`
+}
+
+var (
+	checksumCache      map[string]checksumCacheEntry = nil
+	checksumCacheLock  sync.Mutex
+	checksumCacheDirty bool = false
+	NoChecksumCache    bool = false
+)
+
+// checksumCachePath returns the path of the on-disk checksum cache
+func checksumCachePath() string {
+	return filepath.Join(TmpBasePath, "checksums.json")
+}
+
+// loadChecksumCache reads the checksum cache from disk. The lock must be held.
+func loadChecksumCache() {
+	checksumCache = make(map[string]checksumCacheEntry, 0)
+
+	b, err := ioutil.ReadFile(checksumCachePath())
+	if err != nil {
+		return
+	}
+
+	if err := json.Unmarshal(b, &checksumCache); err != nil {
+		Dprintf("Ignoring invalid checksum cache %s: %s\n", checksumCachePath(), err.Error())
+		checksumCache = make(map[string]checksumCacheEntry, 0)
+	}
+}
+
+// CachedFileChecksum returns the checksum of a file. If the size and
+// modification time of the file match its entry in the checksum cache, the
+// cached checksum is returned instead of reading the file.
+func CachedFileChecksum(path string, checksumType string) (string, error) {
+	if NoChecksumCache {
+		return FileChecksum(path, checksumType)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	checksumCacheLock.Lock()
+	if checksumCache == nil {
+		loadChecksumCache()
+	}
+	entry, ok := checksumCache[key]
+	checksumCacheLock.Unlock()
+
+	if ok && entry.Size == fi.Size() && entry.ModTime == fi.ModTime().UnixNano() && entry.Type == checksumType {
+		return entry.Sum, nil
+	}
+
+	sum, err := FileChecksum(path, checksumType)
+	if err != nil {
+		return "", err
+	}
+
+	checksumCacheLock.Lock()
+	entry = checksumCacheEntry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Type:    checksumType,
+		Sum:     sum,
+	}
+	if prev, ok := checksumCache[key]; ok && prev.Size == entry.Size && prev.ModTime == entry.ModTime {
+		entry.Signed = prev.Signed
+	}
+	checksumCache[key] = entry
+	checksumCacheDirty = true
+	checksumCacheLock.Unlock()
+
+	return sum, nil
+}
+
+// CachedIsSigned returns true if a package file has a signature. If the size
+// and modification time of the file match its entry in the checksum cache, the
+// cached result is returned instead of calling fn to read the file.
+func CachedIsSigned(path string, fn func(path string) (bool, error)) (bool, error) {
+	if NoChecksumCache {
+		return fn(path)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+
+	checksumCacheLock.Lock()
+	if checksumCache == nil {
+		loadChecksumCache()
+	}
+	entry, ok := checksumCache[key]
+	checksumCacheLock.Unlock()
+
+	if ok && entry.Size == fi.Size() && entry.ModTime == fi.ModTime().UnixNano() && entry.Signed != nil {
+		return *entry.Signed, nil
+	}
+
+	signed, err := fn(path)
+	if err != nil {
+		return false, err
+	}
+
+	checksumCacheLock.Lock()
+	entry, ok = checksumCache[key]
+	if !ok || entry.Size != fi.Size() || entry.ModTime != fi.ModTime().UnixNano() {
+		entry = checksumCacheEntry{
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().UnixNano(),
+		}
+	}
+	entry.Signed = &signed
+	checksumCache[key] = entry
+	checksumCacheDirty = true
+	checksumCacheLock.Unlock()
+
+	return signed, nil
+}
+
+// SaveChecksumCache writes the checksum cache to disk if it has changed.
+// Entries for files which no longer exist are discarded.
+func SaveChecksumCache() error {
+	checksumCacheLock.Lock()
+	defer checksumCacheLock.Unlock()
+
+	if !checksumCacheDirty {
+		return nil
+	}
+
+	for path := range checksumCache {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(checksumCache, path)
+		}
+	}
+
+	b, err := json.Marshal(checksumCache)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(TmpBasePath, 0750); err != nil {
+		return err
+	}
+
+	if err := WriteFileAtomic(checksumCachePath(), b, 0640); err != nil {
+		return err
+	}
+
+	checksumCacheDirty = false
+	return nil
+}
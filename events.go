@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	eventsHandle *os.File = nil
+	eventsLock   sync.Mutex
+)
+
+// OpenEvents starts writing sync events as newline delimited JSON to the
+// given path, or to STDOUT if the path is "-". Events are appended to an
+// existing file so that it may be tailed.
+func OpenEvents(path string) error {
+	if path == "-" {
+		eventsHandle = os.Stdout
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	eventsHandle = f
+	return nil
+}
+
+// CloseEvents stops writing sync events
+func CloseEvents() {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	if eventsHandle != nil && eventsHandle != os.Stdout {
+		eventsHandle.Close()
+	}
+	eventsHandle = nil
+}
+
+// emitEvent writes a single event with the given fields, if events are
+// enabled
+func emitEvent(event string, fields map[string]interface{}) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	if eventsHandle == nil {
+		return
+	}
+
+	fields["event"] = event
+	fields["timestamp"] = time.Now().Format(time.RFC3339)
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		Errorf(err, "Failed to encode %s event", event)
+		return
+	}
+
+	eventsHandle.Write(append(b, '\n'))
+}
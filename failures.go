@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// WriteFailures writes the repos which failed to syncronize to a file which
+// may be read back with --retry-failed. Each line lists the tab separated ID,
+// local path, upstream URL and error of a failed repo. The file is emptied if
+// no repos failed.
+func WriteFailures(path string, repos []Repo, stats []RepoStats) error {
+	var buf bytes.Buffer
+	for i, repo := range repos {
+		if i >= len(stats) || stats[i].Error == "" {
+			continue
+		}
+
+		url := repo.Parameters["baseurl"]
+		for _, key := range []string{"metalink", "mirrorlist"} {
+			if url == "" {
+				url = repo.Parameters[key]
+			}
+		}
+
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\n", repo.ID, repo.Path(), url, strings.Replace(stats[i].Error, "\n", " ", -1))
+	}
+
+	return WriteFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// ReadFailures returns the IDs of the repos listed in a failures file written
+// by WriteFailures
+func ReadFailures(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if id := strings.TrimSpace(fields[0]); id != "" && !strings.HasPrefix(id, "#") {
+			ids = append(ids, id)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+// freeSpace is not supported on this platform
+func freeSpace(path string) (int64, error) {
+	return 0, NewErrorf("Free disk space cannot be determined on this platform")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Hardlink replaces duplicate copies of a package found in the given repos
+// with hardlinks to a single copy. Packages are considered duplicates if they
+// have the same NEVRA and checksum in their repo database and the checksum of
+// each file on disk matches. Files on different filesystems are not linked.
+func (c *Yumfile) Hardlink(repos []Repo) {
+	Printf("Hardlinking duplicate packages...\n")
+
+	files := make(map[string]string, 0)
+	linked := 0
+	var saved int64 = 0
+
+	for _, repo := range repos {
+		packages, err := LoadPackages(repo.Path())
+		if err != nil {
+			Dprintf("Skipping hardlinks for %s: %s\n", repo.ID, err.Error())
+			continue
+		}
+
+		for _, pkg := range packages {
+			key := pkg.NEVRA() + ":" + pkg.Checksum.Type + ":" + strings.ToLower(strings.TrimSpace(pkg.Checksum.Value))
+			path := filepath.Join(repo.Path(), pkg.Location.Href)
+
+			src, ok := files[key]
+			if !ok {
+				if _, err := os.Stat(path); err == nil {
+					files[key] = path
+				}
+				continue
+			}
+
+			size, err := hardlink(src, path, &pkg)
+			if err != nil {
+				Errorf(err, "Failed to hardlink %s to %s", path, src)
+				continue
+			}
+
+			if size > 0 {
+				linked++
+				saved += size
+			}
+		}
+	}
+
+	if err := SaveChecksumCache(); err != nil {
+		Errorf(err, "Failed to save checksum cache")
+	}
+
+	Printf("Hardlinked %d duplicate packages (%s reclaimed)\n", linked, bytesToStr(saved))
+}
+
+// hardlink replaces dst with a hardlink to src if both files match the
+// checksum of the given package and are on the same filesystem. The size of
+// the replaced file is returned, or zero if the file was not replaced.
+func hardlink(src, dst string, pkg *Package) (int64, error) {
+	sfi, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+
+	dfi, err := os.Stat(dst)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if os.SameFile(sfi, dfi) || !sameDevice(sfi, dfi) {
+		return 0, nil
+	}
+
+	sum := strings.ToLower(strings.TrimSpace(pkg.Checksum.Value))
+	for _, path := range []string{src, dst} {
+		s, err := CachedFileChecksum(path, pkg.Checksum.Type)
+		if err != nil {
+			return 0, err
+		}
+
+		if s != sum {
+			return 0, NewErrorf("Checksum mismatch for %s", path)
+		}
+	}
+
+	// replace dst atomically
+	tmp := dst + ".y10k-link"
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	Dprintf("Hardlinked %s to %s\n", dst, src)
+	return dfi.Size(), nil
+}
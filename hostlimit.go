@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	hostSlots     = make(map[string]chan bool, 0)
+	hostSlotsLock sync.Mutex
+)
+
+// repoHost returns the host name of the first upstream URL of a repo, or an
+// empty string for repos mirrored from a local path
+func repoHost(repo *Repo) string {
+	for _, key := range []string{"baseurl", "mirrorlist", "metalink"} {
+		for _, s := range strings.Fields(repo.Parameters[key]) {
+			if u, err := url.Parse(s); err == nil && u.Host != "" {
+				return strings.ToLower(u.Host)
+			}
+		}
+	}
+
+	return ""
+}
+
+// acquireHost waits until fewer than HostConcurrency repos are being
+// downloaded from the upstream host of the given repo and returns a function
+// which releases the slot. Repos are not limited if HostConcurrency is zero.
+func acquireHost(repo *Repo) func() {
+	host := repoHost(repo)
+	if HostConcurrency < 1 || host == "" {
+		return func() {}
+	}
+
+	hostSlotsLock.Lock()
+	slots, ok := hostSlots[host]
+	if !ok {
+		slots = make(chan bool, HostConcurrency)
+		hostSlots[host] = slots
+	}
+	hostSlotsLock.Unlock()
+
+	select {
+	case slots <- true:
+	default:
+		Printf("Waiting for another download from %s to finish: %s\n", host, repo.ID)
+		slots <- true
+	}
+
+	return func() {
+		<-slots
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,27 +22,132 @@ const (
 	LOG_CAT_DEBUG
 )
 
+// credentialPatterns match credentials which may appear in the debug output
+// of child processes, such as the HTTP headers traced by urlgrabber
+var credentialPatterns = []*regexp.Regexp{
+	regexp.MustCompile("(?i)((?:proxy-)?authorization:\\s*)\\S.*"),
+	regexp.MustCompile("(://[^/:@\\s]*:)[^/@\\s]*(@)"),
+}
+
+var logColors = map[int]string{
+	LOG_CAT_ERROR: "\x1b[31m", // red
+	LOG_CAT_WARN:  "\x1b[33m", // yellow
+	LOG_CAT_INFO:  "\x1b[32m", // green
+	LOG_CAT_DEBUG: "\x1b[36m", // cyan
+}
+
 var (
-	cmd           *exec.Cmd   = nil
-	logfileHandle *os.File    = nil
-	logger        *log.Logger = nil
+	children        = make(map[*exec.Cmd]bool, 0)
+	childrenKilled  = false
+	childrenLock    sync.Mutex
+	logLock         sync.Mutex
+	logfileHandle   *os.File    = nil
+	logger          *log.Logger = nil
+	logRotateFailed bool        = false
+	logToSyslog     bool        = false
+	stdoutReserved  bool        = false
 )
 
 func InitLogFile() {
+	if LogTarget == "syslog" {
+		if err := initSyslog(SyslogFacility); err != nil {
+			Exitf(EXIT_CONFIG, err, "Failed to initialize syslog")
+		}
+
+		logToSyslog = true
+		return
+	}
+
 	if LogFilePath == "" {
 		return
 	}
 
 	f, err := os.OpenFile(LogFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	PanicOn(err)
+	if err != nil {
+		Exitf(EXIT_DISK, err, "Failed to open log file")
+	}
+
+	logfileHandle = f
+	logger = newLogger(f)
+}
+
+// newLogger returns a logger for the given log file handle. Timestamps are
+// omitted in JSON mode as each entry carries its own timestamp field.
+func newLogger(f *os.File) *log.Logger {
+	if LogFormat == "json" {
+		return log.New(f, "", 0)
+	}
 
-	logger = log.New(f, "", log.LstdFlags)
+	return log.New(f, "", log.LstdFlags)
+}
+
+// rotateLogFile shifts the current log file to .1 (and any older backups up
+// by one) and reopens a fresh log file if it has exceeded LogMaxSize.
+func rotateLogFile() {
+	if LogMaxSize <= 0 || logfileHandle == nil || logRotateFailed {
+		return
+	}
+
+	fi, err := logfileHandle.Stat()
+	if err != nil || fi.Size() < LogMaxSize {
+		return
+	}
+
+	// shift older backups, discarding the oldest
+	err = nil
+	if LogMaxBackups > 0 {
+		for i := LogMaxBackups - 1; i > 0 && err == nil; i-- {
+			src := fmt.Sprintf("%s.%d", LogFilePath, i)
+			if _, serr := os.Stat(src); serr == nil {
+				err = os.Rename(src, fmt.Sprintf("%s.%d", LogFilePath, i+1))
+			}
+		}
+
+		if err == nil {
+			err = os.Rename(LogFilePath, LogFilePath+".1")
+		}
+	} else {
+		err = os.Remove(LogFilePath)
+	}
+
+	if err != nil {
+		// keep writing to the current file and warn only once
+		logRotateFailed = true
+		writeLog("WARNING", fmt.Sprintf("Failed to rotate log file %s: %s\n", LogFilePath, err.Error()))
+		return
+	}
+
+	f, err := os.OpenFile(LogFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		logRotateFailed = true
+		writeLog("WARNING", fmt.Sprintf("Failed to reopen log file %s after rotation: %s\n", LogFilePath, err.Error()))
+		return
+	}
+
+	logfileHandle.Close()
+	logfileHandle = f
+	logger = newLogger(f)
 }
 
 // CloseLogFile cleans up any file handles associates with the log file.
+// Subsequent output is written to STDOUT/STDERR.
 func CloseLogFile() {
-	if logfileHandle != nil {
-		PanicOn(logfileHandle.Close())
+	logLock.Lock()
+	if logToSyslog {
+		logToSyslog = false
+		closeSyslog()
+	}
+
+	f := logfileHandle
+	logfileHandle = nil
+	logger = nil
+	logLock.Unlock()
+
+	if f != nil {
+		f.Sync()
+		if err := f.Close(); err != nil {
+			Errorf(err, "Failed to close log file %s", LogFilePath)
+		}
 	}
 }
 
@@ -53,28 +164,107 @@ func Logf(category int, format string, a ...interface{}) {
 	case LOG_CAT_DEBUG:
 		cat = "DEBUG"
 	default:
-		panic(fmt.Sprintf("Unrecognized log category: %s", category))
+		// don't crash a running sync over a bad log category
+		format = fmt.Sprintf("(WARNING: unrecognized log category: %d) %s", category, format)
+		cat = "INFO"
+		category = LOG_CAT_INFO
+	}
+
+	msg := fmt.Sprintf(format, a...)
+
+	// serialize writes and log rotation across goroutines
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	switch {
+	case logToSyslog:
+		syslogf(category, strings.TrimRight(msg, "\n"))
+
+	case logger != nil:
+		writeLog(cat, msg)
+		rotateLogFile()
+
+	default:
+		// the log was closed after the caller checked for it
+		if category == LOG_CAT_INFO {
+			if !QuietMode {
+				fmt.Fprint(stdout(), msg)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "%s %s\n", colorize(os.Stderr, category, cat+":"), strings.TrimRight(msg, "\n"))
+		}
 	}
+}
 
-	logger.Printf("%s %s", cat, fmt.Sprintf(format, a...))
+// writeLog writes a message to the log file in the configured format
+func writeLog(cat, msg string) {
+	if LogFormat == "json" {
+		entry := map[string]string{
+			"timestamp": time.Now().Format(time.RFC3339),
+			"level":     cat,
+			"message":   strings.TrimRight(msg, "\n"),
+		}
+
+		b, err := json.Marshal(entry)
+		if err != nil {
+			panic(err)
+		}
+
+		logger.Println(string(b))
+	} else {
+		logger.Printf("%s %s", cat, msg)
+	}
 }
 
-// Printf prints output to STDOUT or the logfile
+// logEnabled returns true if output is written to a log file or syslog
+func logEnabled() bool {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	return logger != nil || logToSyslog
+}
+
+// Printf prints output to STDOUT or the logfile. Output to STDOUT is
+// suppressed in quiet mode.
 func Printf(format string, a ...interface{}) {
-	if logger == nil {
-		fmt.Printf(format, a...)
+	if !logEnabled() {
+		if !QuietMode {
+			fmt.Fprintf(stdout(), format, a...)
+		}
 	} else {
 		Logf(LOG_CAT_INFO, format, a...)
 	}
 }
 
+// Outputf prints the output of a command, such as a list of repos, to
+// STDOUT. Unlike Printf, output is never suppressed in quiet mode or written
+// to the log file.
+func Outputf(format string, a ...interface{}) {
+	fmt.Fprintf(stdout(), format, a...)
+}
+
+// ReserveStdout sends all output written by Printf and Outputf to STDERR so
+// that machine readable output written to STDOUT is not mixed with it
+func ReserveStdout() {
+	stdoutReserved = true
+}
+
+// stdout returns the file to which Printf and Outputf write
+func stdout() *os.File {
+	if stdoutReserved {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
+
 // Errorf prints an error message to log or STDOUT
 func Errorf(err error, format string, a ...interface{}) {
-	if logger == nil {
+	if !logEnabled() {
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", fmt.Sprintf(format, a...), err.Error())
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", colorize(os.Stderr, LOG_CAT_ERROR, "ERROR:"), fmt.Sprintf(format, a...), err.Error())
 		} else {
-			fmt.Fprintf(os.Stderr, "ERROR: %s\n", fmt.Sprintf(format, a...))
+			fmt.Fprintf(os.Stderr, "%s %s\n", colorize(os.Stderr, LOG_CAT_ERROR, "ERROR:"), fmt.Sprintf(format, a...))
 		}
 	} else {
 		if err != nil {
@@ -85,34 +275,85 @@ func Errorf(err error, format string, a ...interface{}) {
 	}
 }
 
+// Warnf prints a warning message to log or STDERR
+func Warnf(format string, a ...interface{}) {
+	if !logEnabled() {
+		fmt.Fprintf(os.Stderr, "%s %s\n", colorize(os.Stderr, LOG_CAT_WARN, "WARNING:"), strings.TrimRight(fmt.Sprintf(format, a...), "\n"))
+	} else {
+		Logf(LOG_CAT_WARN, format, a...)
+	}
+}
+
 // Fatalf prints an error message to log or STDOUT and exits the program with
-// a non-zero exit code
+// a non-zero exit code. If err is an ExitError, its exit code is used.
 func Fatalf(err error, format string, a ...interface{}) {
+	Exitf(exitCode(err), err, format, a...)
+}
+
+// Exitf prints an error message to log or STDOUT and exits the program with
+// the given exit code
+func Exitf(code int, err error, format string, a ...interface{}) {
 	Errorf(err, format, a...)
-	os.Exit(1)
+	CloseLogFile()
+	os.Exit(code)
 }
 
-// Dprintf prints verbose output only if debug mode is enabled
+// Dprintf prints verbose output only if debug mode is enabled. Each message
+// is terminated with exactly one newline, whether or not the format string
+// includes one.
 func Dprintf(format string, a ...interface{}) {
 	if DebugMode {
-		if logger == nil {
-			fmt.Fprintf(os.Stderr, fmt.Sprintf("DEBUG: %s", format), a...)
+		msg := strings.TrimRight(fmt.Sprintf(format, a...), "\n")
+		if !logEnabled() {
+			fmt.Fprintf(os.Stderr, "%s %s\n", colorize(os.Stderr, LOG_CAT_DEBUG, "DEBUG:"), msg)
 		} else {
-			Logf(LOG_CAT_DEBUG, format, a...)
+			Logf(LOG_CAT_DEBUG, "%s\n", msg)
 		}
 	}
 }
 
+// colorize wraps a log category prefix in terminal color codes if the given
+// file is a TTY and color output has not been disabled
+func colorize(f *os.File, category int, s string) string {
+	if NoColor {
+		return s
+	}
+
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return s
+	}
+
+	return logColors[category] + s + "\x1b[0m"
+}
+
 // Exec executes a system command and redirects the commands output to debug
 func Exec(path string, args ...string) error {
-	if cmd != nil {
-		return NewErrorf("Child process is aleady running (%s:%d)", cmd.Path, cmd.Process.Pid)
+	return ExecLines("", nil, path, args...)
+}
+
+// ExecLines executes a system command and passes each line written to STDOUT
+// to the given handler. If the handler is nil, STDOUT is redirected to debug.
+// STDERR is always redirected to debug. Debug output is prefixed with the given
+// label, if any.
+func ExecLines(label string, handler func(line string), path string, args ...string) error {
+	return ExecLinesEnv(label, nil, handler, path, args...)
+}
+
+// ExecLinesEnv is the same as ExecLines but adds the given "KEY=value"
+// variables to the environment of the command
+func ExecLinesEnv(label string, env []string, handler func(line string), path string, args ...string) error {
+	cmd := exec.Command(path, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 
-	cmd = exec.Command(path, args...)
-	defer func() {
-		cmd = nil
-	}()
+	prefix := cmd.Path
+	if label != "" {
+		prefix = fmt.Sprintf("%s: %s", label, cmd.Path)
+	}
+
+	var wg sync.WaitGroup
 
 	// parse stdout async
 	stdout, err := cmd.StdoutPipe()
@@ -120,10 +361,16 @@ func Exec(path string, args ...string) error {
 		return err
 	}
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		scanner := bufio.NewScanner(stdout)
 		for scanner.Scan() {
-			Dprintf("%s: %s\n", cmd.Path, scanner.Text())
+			if handler != nil {
+				handler(scanner.Text())
+			} else {
+				Dprintf("%s: %s\n", prefix, redactCredentials(scanner.Text()))
+			}
 		}
 	}()
 
@@ -133,28 +380,101 @@ func Exec(path string, args ...string) error {
 		return err
 	}
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
-			Dprintf("%s: %s\n", cmd.Path, scanner.Text())
+			Dprintf("%s: %s\n", prefix, redactCredentials(scanner.Text()))
 		}
 	}()
 
 	// execute
 	Dprintf("exec: %s %s\n", path, strings.Join(args, " "))
+	childrenLock.Lock()
+	if childrenKilled {
+		childrenLock.Unlock()
+		return NewErrorf("Not starting %s as child processes have been terminated", path)
+	}
 	err = cmd.Start()
+	if err == nil {
+		children[cmd] = true
+	}
+	childrenLock.Unlock()
 	if err != nil {
 		return err
 	}
+
+	defer func() {
+		childrenLock.Lock()
+		delete(children, cmd)
+		childrenLock.Unlock()
+	}()
+
 	Dprintf("exec: started with PID: %d\n", cmd.Process.Pid)
 
-	// wait for process to finish
+	// wait for output to drain and process to finish
+	wg.Wait()
 	err = cmd.Wait()
 	if err != nil {
 		return err
 	}
-	Dprintf("exec: finished\n")
-	cmd = nil
+	Dprintf("exec: finished %s (PID: %d)\n", prefix, cmd.Process.Pid)
 
 	return nil
 }
+
+// redactCredentials replaces any authorization header values and passwords
+// in URLs found in a line of command output
+func redactCredentials(line string) string {
+	for _, pattern := range credentialPatterns {
+		line = pattern.ReplaceAllString(line, "${1}<redacted>${2}")
+	}
+
+	return line
+}
+
+// KillChildren terminates all child processes started by Exec. No further
+// child processes are started.
+func KillChildren() {
+	childrenLock.Lock()
+	defer childrenLock.Unlock()
+
+	childrenKilled = true
+
+	for cmd := range children {
+		Printf("Attempting to terminate %s (PID: %d)...\n", cmd.Path, cmd.Process.Pid)
+		cmd.Process.Kill()
+	}
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory as the
+// given path and renames it into place, so that readers never see a partially
+// written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withLogFile opens a log file in a temporary directory for the duration of
+// a test and returns its path
+func withLogFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "y10k-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	LogFilePath = filepath.Join(dir, "y10k.log")
+	LogTarget = "file"
+	LogFormat = "text"
+	InitLogFile()
+
+	return LogFilePath, func() {
+		CloseLogFile()
+		LogFilePath = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCloseLogFile(t *testing.T) {
+	path, cleanup := withLogFile(t)
+	defer cleanup()
+
+	Printf("hello\n")
+
+	f := logfileHandle
+	if f == nil {
+		t.Fatalf("log file handle not set by InitLogFile")
+	}
+
+	CloseLogFile()
+	if logfileHandle != nil || logger != nil {
+		t.Errorf("log file still open after CloseLogFile")
+	}
+
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Errorf("log file handle was not released by CloseLogFile")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), "INFO hello") {
+		t.Errorf("expected message in log file, got: %q", string(b))
+	}
+}
+
+func TestLogWhileClosing(t *testing.T) {
+	_, cleanup := withLogFile(t)
+	defer cleanup()
+
+	QuietMode = true
+	defer func() { QuietMode = false }()
+
+	// log from several goroutines while the log file is closed, as happens
+	// when a sync is interrupted
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				Printf("message %d\n", j)
+			}
+		}()
+	}
+
+	CloseLogFile()
+	wg.Wait()
+}
+
+func TestLogfUnknownCategory(t *testing.T) {
+	path, cleanup := withLogFile(t)
+	defer cleanup()
+
+	// an unrecognized category must not panic
+	Logf(42, "hello\n")
+	CloseLogFile()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), "INFO (WARNING: unrecognized log category") || !strings.Contains(string(b), "hello") {
+		t.Errorf("expected message logged at INFO with a warning, got: %q", string(b))
+	}
+
+	// the warning names the category given, not the INFO fallback
+	if !strings.Contains(string(b), "category: 42)") {
+		t.Errorf("expected the unrecognized category in the warning, got: %q", string(b))
+	}
+}
+
+// captureStderr returns everything written to STDERR by fn
+func captureStderr(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stderr := os.Stderr
+	os.Stderr = w
+	fn()
+	os.Stderr = stderr
+	w.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestDprintfConsistentOutput(t *testing.T) {
+	DebugMode = true
+	defer func() { DebugMode = false }()
+
+	debug := func() {
+		Dprintf("message %d", 1)
+		Dprintf("message %d\n", 2)
+		Dprintf("message %d\n\n", 3)
+	}
+
+	want := "message 1\nmessage 2\nmessage 3\n"
+
+	// STDERR
+	out := captureStderr(t, debug)
+	if got := strings.Replace(out, "DEBUG: ", "", -1); got != want {
+		t.Errorf("unexpected debug output on STDERR: %q", out)
+	}
+
+	// log file
+	path, cleanup := withLogFile(t)
+	defer cleanup()
+
+	debug()
+	CloseLogFile()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ""
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if i := strings.Index(line, "DEBUG "); i >= 0 {
+			got += line[i+len("DEBUG "):]
+		}
+	}
+
+	if got != want {
+		t.Errorf("unexpected debug output in log file: %q", string(b))
+	}
+}
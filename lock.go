@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errLocked = errors.New("locked by another process")
+
+var (
+	lockHandles = make([]*os.File, 0)
+	locksLock   sync.Mutex
+)
+
+// LockRepos locks the local mirror of each given repo to prevent concurrent
+// syncs of the same mirror, waiting up to the given timeout for each lock.
+// The lock file of a mirror is kept next to it, so that processes using
+// different temporary paths still exclude each other.
+func LockRepos(repos []Repo, timeout time.Duration) error {
+	paths := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		path, err := filepath.Abs(repo.Path())
+		if err != nil {
+			return NewExitError(EXIT_DISK, err)
+		}
+
+		path = filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".lock")
+		if !containsString(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+
+	// lock in a consistent order so that two processes waiting on each other
+	// cannot deadlock
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := AcquireLock(path, timeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AcquireLock takes an exclusive lock on the given lock file, waiting up to
+// the given timeout for another process to release it. The lock is held
+// until ReleaseLock is called or the process exits.
+func AcquireLock(path string, timeout time.Duration) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return NewExitError(EXIT_DISK, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return NewExitError(EXIT_DISK, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err = tryLock(f)
+		if err != errLocked {
+			break
+		}
+
+		if !time.Now().Before(deadline) {
+			pid, _ := ioutil.ReadFile(path)
+			f.Close()
+			return NewExitError(EXIT_LOCKED, NewErrorf("%s is locked by another y10k process (PID: %s)", path, strings.TrimSpace(string(pid))))
+		}
+
+		if !waiting {
+			Printf("Waiting up to %s for lock on %s...\n", timeout, path)
+			waiting = true
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	if err != nil {
+		f.Close()
+		return NewExitError(EXIT_DISK, err)
+	}
+
+	// record the PID of the lock holder
+	f.Truncate(0)
+	f.Seek(0, 0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Sync()
+
+	Dprintf("Acquired lock: %s\n", path)
+	locksLock.Lock()
+	lockHandles = append(lockHandles, f)
+	locksLock.Unlock()
+	return nil
+}
+
+// ReleaseLock releases all locks taken by AcquireLock, if any
+func ReleaseLock() {
+	locksLock.Lock()
+	handles := lockHandles
+	lockHandles = make([]*os.File, 0)
+	locksLock.Unlock()
+
+	for _, f := range handles {
+		f.Truncate(0)
+		f.Close()
+	}
+}
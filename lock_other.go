@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"os"
+)
+
+// tryLock is a no-op as file locking is not supported on this platform
+func tryLock(f *os.File) error {
+	return nil
+}
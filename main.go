@@ -6,17 +6,54 @@ import (
 	"github.com/codegangsta/cli"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
-	QuietMode       bool
-	DebugMode       bool
-	YumfilePath     string
-	LogFilePath     string
-	TmpBasePath     string
-	TmpYumConfPath  string
-	TmpYumLogFile   string
-	TmpYumCachePath string
+	QuietMode         bool
+	DebugMode         bool
+	YumfilePath       string
+	YumfileFormat     string
+	LogFilePath       string
+	TmpBasePath       string
+	TmpYumLogFile     string
+	TmpYumCachePath   string
+	DownloadRetries   int
+	DownloadTimeout   int
+	DownloadRateLimit int64
+	DownloadMinRate   int64
+	LogMaxSize        int64
+	LogMaxBackups     int
+	LogFormat         string
+	LogTarget         string
+	SyslogFacility    string
+	NoColor           bool
+	DryRun            bool
+	DeleteRemoved     bool
+	RepoConcurrency   int
+	HostConcurrency   int
+	Releasever        string
+	Basearch          string
+	ManifestDir       string
+	MinFreeSpace      int64
+	MaxDownloadSize   int64
+	Staging           bool
+	SyncWindow        *TimeWindow
+	NetrcPath         string
+)
+
+// Exit codes
+const (
+	EXIT_OK          = iota // success
+	EXIT_ERROR              // unspecified error
+	EXIT_INTERRUPTED        // interrupted by a signal
+	EXIT_CONFIG             // invalid Yumfile or command line options
+	EXIT_NETWORK            // failed to download from an upstream repo
+	EXIT_VERIFY             // corrupt or missing packages
+	EXIT_DISK               // failed to read or write local files
+	EXIT_PARTIAL            // some, but not all, repos failed
+	EXIT_LOCKED             // another sync holds the lock
 )
 
 func main() {
@@ -36,21 +73,97 @@ func main() {
 			Usage:  "redirect output to a log file",
 			EnvVar: "Y10K_LOGFILE",
 		},
+		cli.StringFlag{
+			Name:   "log-target",
+			Usage:  "log destination (file or syslog)",
+			Value:  "file",
+			EnvVar: "Y10K_LOG_TARGET",
+		},
+		cli.StringFlag{
+			Name:   "syslog-facility",
+			Usage:  "syslog facility used with --log-target=syslog",
+			Value:  "daemon",
+			EnvVar: "Y10K_SYSLOG_FACILITY",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "log file format (text or json)",
+			Value:  "text",
+			EnvVar: "Y10K_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-max-size",
+			Usage:  "rotate the log file when it exceeds this size (e.g. 10MB)",
+			EnvVar: "Y10K_LOG_MAX_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "log-max-backups",
+			Usage:  "number of rotated log files to keep",
+			Value:  5,
+			EnvVar: "Y10K_LOG_MAX_BACKUPS",
+		},
 		cli.BoolFlag{
 			Name:  "quiet, q",
-			Usage: "less verbose",
+			Usage: "suppress all output except errors",
 		},
 		cli.BoolFlag{
 			Name:   "debug, d",
 			Usage:  "print debug output",
 			EnvVar: "Y10K_DEBUG",
 		},
+		cli.BoolFlag{
+			Name:   "no-color",
+			Usage:  "disable colored terminal output",
+			EnvVar: "Y10K_NO_COLOR",
+		},
 		cli.StringFlag{
 			Name:   "tmppath, t",
 			Usage:  "path to y10k temporary objects",
 			Value:  "/tmp/y10k",
 			EnvVar: "Y10K_TMPPATH",
 		},
+		cli.BoolFlag{
+			Name:   "no-checksum-cache",
+			Usage:  "always recompute package checksums and signatures instead of trusting cached values",
+			EnvVar: "Y10K_NO_CHECKSUM_CACHE",
+		},
+		cli.StringFlag{
+			Name:   "releasever",
+			Usage:  "value of $releasever in a Yumfile",
+			EnvVar: "Y10K_RELEASEVER",
+		},
+		cli.StringFlag{
+			Name:   "basearch",
+			Usage:  "value of $basearch in a Yumfile",
+			EnvVar: "Y10K_BASEARCH",
+		},
+		cli.StringFlag{
+			Name:   "netrc",
+			Usage:  "netrc file to read repo credentials from (default: ~/.netrc)",
+			EnvVar: "Y10K_NETRC",
+		},
+		cli.IntFlag{
+			Name:   "retries, r",
+			Usage:  "number of times to retry a failed download",
+			Value:  3,
+			EnvVar: "Y10K_RETRIES",
+		},
+		cli.IntFlag{
+			Name:   "timeout",
+			Usage:  "seconds to wait for a stalled connection",
+			Value:  5,
+			EnvVar: "Y10K_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "rate-limit",
+			Usage:  "maximum download rate in bytes/sec, shared by all repos (e.g. 512KB, 10MB)",
+			EnvVar: "Y10K_RATE_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "min-rate",
+			Usage:  "abort a download that stays below this rate in bytes/sec for --timeout seconds (e.g. 1KB)",
+			EnvVar: "Y10K_MIN_RATE",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -63,27 +176,136 @@ func main() {
 					Usage: "path to Yumfile",
 					Value: "./Yumfile",
 				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Yumfile format (auto, ini or yaml)",
+					Value: "auto",
+				},
 			},
 			Before: func(context *cli.Context) error {
 				YumfilePath = context.String("file")
+				YumfileFormat = context.String("format")
+				if YumfileFormat != "auto" && YumfileFormat != "ini" && YumfileFormat != "yaml" {
+					Exitf(EXIT_CONFIG, nil, "Unsupported Yumfile format: %s", YumfileFormat)
+				}
+
 				return nil
 			},
 			Subcommands: []cli.Command{
 				{
 					Name:   "validate",
-					Usage:  "validate a Yumfile's syntax",
+					Usage:  "validate a Yumfile and report all problems found",
 					Action: ActionYumfileValidate,
 				},
 				{
-					Name:   "list",
-					Usage:  "list repositories in a Yumfile",
+					Name:  "list",
+					Usage: "list repositories in a Yumfile, or the upstream packages of a repo",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "print packages as JSON",
+						},
+					},
 					Action: ActionYumfileList,
 				},
 				{
-					Name:   "sync",
-					Usage:  "syncronize repos described in a Yumfile",
+					Name:  "sync",
+					Usage: "syncronize repos described in a Yumfile",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run, n",
+							Usage: "list packages that would be downloaded without downloading them",
+						},
+						cli.BoolFlag{
+							Name:  "delete",
+							Usage: "delete local packages that have been removed upstream",
+						},
+						cli.StringSliceFlag{
+							Name:  "repo",
+							Usage: "syncronize only the given repo (may be repeated)",
+							Value: &cli.StringSlice{},
+						},
+						cli.StringSliceFlag{
+							Name:  "exclude-repo",
+							Usage: "do not syncronize the given repo (may be repeated)",
+							Value: &cli.StringSlice{},
+						},
+						cli.IntFlag{
+							Name:  "repo-concurrency",
+							Usage: "number of repos to syncronize in parallel",
+							Value: 1,
+						},
+						cli.IntFlag{
+							Name:  "host-concurrency",
+							Usage: "maximum number of repos downloaded from the same host at once (default: no limit)",
+						},
+						cli.StringFlag{
+							Name:  "failures",
+							Usage: "write the repos which failed to syncronize to a file",
+						},
+						cli.StringFlag{
+							Name:  "retry-failed",
+							Usage: "syncronize only the repos listed in a failures file",
+						},
+						cli.StringFlag{
+							Name:  "events",
+							Usage: "write sync events as newline delimited JSON to a file (or - for STDOUT)",
+						},
+						cli.StringFlag{
+							Name:  "report",
+							Usage: "write a JSON summary of the sync to a file (or - for STDOUT)",
+						},
+						cli.IntFlag{
+							Name:  "lock-timeout",
+							Usage: "seconds to wait for another sync to finish before giving up",
+						},
+						cli.StringFlag{
+							Name:  "min-free-space",
+							Usage: "abort the sync if free disk space drops below this size (e.g. 10GB)",
+						},
+						cli.StringFlag{
+							Name:  "max-download-size",
+							Usage: "abort the sync once more than this size has been downloaded (e.g. 100GB)",
+						},
+						cli.StringFlag{
+							Name:  "window",
+							Usage: "only start syncronizing repos between these local times (e.g. 22:00-06:00)",
+						},
+						cli.BoolFlag{
+							Name:  "staging",
+							Usage: "syncronize each repo into a staging directory and swap it into place on success",
+						},
+						cli.BoolFlag{
+							Name:  "hardlink",
+							Usage: "replace duplicate packages across the syncronized repos with hardlinks",
+						},
+						cli.StringFlag{
+							Name:  "manifest-dir",
+							Usage: "write a package manifest for each repo to this directory",
+						},
+						cli.StringFlag{
+							Name:  "metrics",
+							Usage: "write Prometheus metrics of the sync to a textfile collector file",
+						},
+					},
 					Action: ActionYumfileSync,
 				},
+				{
+					Name:   "verify",
+					Usage:  "verify the checksums of packages in local mirrors",
+					Action: ActionYumfileVerify,
+				},
+				{
+					Name:  "rebuild",
+					Usage: "recreate the database of local mirrors from the packages on disk",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "lock-timeout",
+							Usage: "seconds to wait for a running sync to finish before giving up",
+						},
+					},
+					Action: ActionYumfileRebuild,
+				},
 			},
 		},
 		{
@@ -99,10 +321,55 @@ func main() {
 		// set globals from command line context
 		QuietMode = context.GlobalBool("quiet")
 		DebugMode = context.GlobalBool("debug")
+		NoColor = context.GlobalBool("no-color")
+		NoChecksumCache = context.GlobalBool("no-checksum-cache")
+		Releasever = context.GlobalString("releasever")
+		Basearch = context.GlobalString("basearch")
+		NetrcPath = context.GlobalString("netrc")
 		LogFilePath = context.GlobalString("logfile")
+		LogMaxBackups = context.GlobalInt("log-max-backups")
+		LogFormat = context.GlobalString("log-format")
+
+		if LogFormat != "text" && LogFormat != "json" {
+			Exitf(EXIT_CONFIG, nil, "Unsupported log format: %s", LogFormat)
+		}
+
+		LogTarget = context.GlobalString("log-target")
+		SyslogFacility = context.GlobalString("syslog-facility")
+		if LogTarget != "file" && LogTarget != "syslog" {
+			Exitf(EXIT_CONFIG, nil, "Unsupported log target: %s", LogTarget)
+		}
+
+		if size := context.GlobalString("log-max-size"); size != "" {
+			if b, err := strToBytes(size); err != nil {
+				Exitf(EXIT_CONFIG, err, "Invalid log file size")
+			} else {
+				LogMaxSize = b
+			}
+		}
+		DownloadRetries = context.GlobalInt("retries")
+		if DownloadRetries < 0 {
+			Exitf(EXIT_CONFIG, nil, "Invalid number of retries: %d", DownloadRetries)
+		}
+		DownloadTimeout = context.GlobalInt("timeout")
+
+		if rate := context.GlobalString("rate-limit"); rate != "" {
+			if b, err := strToBytes(rate); err != nil {
+				Exitf(EXIT_CONFIG, err, "Invalid rate limit")
+			} else {
+				DownloadRateLimit = b
+			}
+		}
+
+		if rate := context.GlobalString("min-rate"); rate != "" {
+			if b, err := strToBytes(rate); err != nil {
+				Exitf(EXIT_CONFIG, err, "Invalid minimum rate")
+			} else {
+				DownloadMinRate = b
+			}
+		}
 
 		TmpBasePath = context.GlobalString("tmppath")
-		TmpYumConfPath = context.GlobalString("tmppath") + "/" + "yum.conf"
 		TmpYumLogFile = context.GlobalString("tmppath") + "/" + "yum.log"
 		TmpYumCachePath = context.GlobalString("tmppath") + "/" + "cache"
 
@@ -114,18 +381,18 @@ func main() {
 
 	// sig handler
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for _ = range c {
-			Printf("Caught SIGINT/Ctrl-C. Cleaning up...\n")
+		for sig := range c {
+			Printf("Caught %s. Cleaning up...\n", sig)
 
-			if cmd != nil {
-				Printf("Attempting to terminate %s (PID: %d)...\n", cmd.Path, cmd.Process.Pid)
-				cmd.Process.Kill()
-			}
+			KillChildren()
+			RemoveStaging()
+			ReleaseLock()
 
 			Printf("Exiting\n")
-			os.Exit(2)
+			CloseLogFile()
+			os.Exit(EXIT_INTERRUPTED)
 		}
 	}()
 
@@ -134,8 +401,19 @@ func main() {
 
 // ActionYumfileValidate processes the 'yumfile validate' command
 func ActionYumfileValidate(context *cli.Context) {
-	yumfile, err := LoadYumfile(YumfilePath)
+	yumfile, err := ParseYumfile(YumfilePath)
 	PanicOn(err)
+
+	// report all problems at once
+	problems := append(yumfile.Problems(), yumfile.PathProblems()...)
+	for _, err := range problems {
+		Errorf(nil, "%s", err.Error())
+	}
+
+	if len(problems) > 0 {
+		Exitf(EXIT_CONFIG, nil, "Found %d problems in %s", len(problems), YumfilePath)
+	}
+
 	Printf("Yumfile appears valid (%d repos)\n", len(yumfile.Repos))
 }
 
@@ -144,34 +422,199 @@ func ActionYumfileList(context *cli.Context) {
 	yumfile, err := LoadYumfile(YumfilePath)
 	PanicOn(err)
 
+	// list upstream packages of a single repo
+	if id := context.Args().First(); id != "" {
+		repo := yumfile.GetRepoByID(id)
+		if repo == nil {
+			Exitf(EXIT_CONFIG, nil, "No such repo found in Yumfile: %s", id)
+		}
+
+		packages, err := yumfile.QueryPackages(repo)
+		if err != nil {
+			Fatalf(err, "Failed to query packages in %s", id)
+		}
+
+		if err := PrintPackages(packages, context.Bool("json")); err != nil {
+			Fatalf(err, "Failed to print packages")
+		}
+
+		return
+	}
+
 	repoCount := len(yumfile.Repos)
 	padding := (len(fmt.Sprintf("%d", repoCount)) * 2) + 1
 	for i, repo := range yumfile.Repos {
-		Printf("%*s %s -> %s\n", padding, fmt.Sprintf("%d/%d", i+1, repoCount), repo.ID, repo.LocalPath)
+		status := ""
+		if !repo.Enabled {
+			status = " (disabled)"
+		}
+
+		Outputf("%*s %s -> %s%s\n", padding, fmt.Sprintf("%d/%d", i+1, repoCount), repo.ID, repo.LocalPath, status)
 	}
 }
 
 // ActionYumfileSync processes the 'yumfile sync' command
 func ActionYumfileSync(context *cli.Context) {
+	// keep STDOUT for the event stream or report
+	if context.String("events") == "-" && context.String("report") == "-" {
+		Exitf(EXIT_CONFIG, nil, "Only one of --events and --report may be written to STDOUT")
+	}
+	if context.String("events") == "-" || context.String("report") == "-" {
+		ReserveStdout()
+	}
+
 	yumfile, err := LoadYumfile(YumfilePath)
 	PanicOn(err)
 
-	repo := context.Args().First()
-	if repo == "" {
-		// sync/update all repos in Yumfile
-		if err := yumfile.SyncAll(); err != nil {
-			Fatalf(err, "Error running Yumfile")
+	DryRun = context.Bool("dry-run")
+	DeleteRemoved = context.Bool("delete")
+	RepoConcurrency = context.Int("repo-concurrency")
+	HostConcurrency = context.Int("host-concurrency")
+	ManifestDir = context.String("manifest-dir")
+	Staging = context.Bool("staging")
+
+	if window := context.String("window"); window != "" {
+		if w, err := ParseTimeWindow(window); err != nil {
+			Exitf(EXIT_CONFIG, err, "Error parsing --window")
+		} else {
+			SyncWindow = w
+		}
+	}
+
+	if size := context.String("min-free-space"); size != "" {
+		if b, err := strToBytes(size); err != nil {
+			Exitf(EXIT_CONFIG, err, "Invalid minimum free space")
+		} else {
+			MinFreeSpace = b
+		}
+	}
+
+	if size := context.String("max-download-size"); size != "" {
+		if b, err := strToBytes(size); err != nil {
+			Exitf(EXIT_CONFIG, err, "Invalid maximum download size")
+		} else {
+			MaxDownloadSize = b
+		}
+	}
+
+	// select repos from arguments and --repo/--exclude-repo
+	ids := context.StringSlice("repo")
+	if context.Args().Present() {
+		ids = append(ids, context.Args()...)
+	}
+
+	if path := context.String("retry-failed"); path != "" {
+		failed, err := ReadFailures(path)
+		if err != nil {
+			Exitf(EXIT_CONFIG, err, "Failed to read failures file")
+		}
+
+		if len(failed) == 0 {
+			Printf("No failed repos to retry in %s\n", path)
+			return
+		}
+
+		ids = append(ids, failed...)
+	}
+
+	repos, err := yumfile.SelectRepos(ids, context.StringSlice("exclude-repo"))
+	if err != nil {
+		Exitf(EXIT_CONFIG, err, "Error selecting repos")
+	}
+
+	// prevent concurrent syncs of the same mirrors
+	if err := LockRepos(repos, time.Duration(context.Int("lock-timeout"))*time.Second); err != nil {
+		Fatalf(err, "Failed to acquire lock")
+	}
+	defer ReleaseLock()
+
+	if path := context.String("events"); path != "" {
+		if err := OpenEvents(path); err != nil {
+			Exitf(EXIT_DISK, err, "Failed to open events file")
+		}
+		defer CloseEvents()
+	}
+
+	stats, err := yumfile.Sync(repos)
+
+	if context.Bool("hardlink") && !DryRun {
+		yumfile.Hardlink(repos)
+	}
+
+	// write reports even if some repos failed
+	if path := context.String("report"); path != "" {
+		if err := WriteReport(path, stats); err != nil {
+			Errorf(err, "Failed to write report to %s", path)
+		}
+	}
+
+	// a dry run would overwrite the failures of the last real sync
+	if path := context.String("failures"); path != "" && !DryRun {
+		if err := WriteFailures(path, repos, stats); err != nil {
+			Errorf(err, "Failed to write failures to %s", path)
+		}
+	}
+
+	// a dry run would hide a stale mirror from alerting
+	if path := context.String("metrics"); path != "" && !DryRun {
+		if err := WriteMetrics(path, stats); err != nil {
+			Errorf(err, "Failed to write metrics to %s", path)
 		}
-	} else {
-		// sync/update one repo in the Yumfile
-		mirror := yumfile.GetRepoByID(repo)
+	}
+
+	if err != nil {
+		Fatalf(err, "Error running Yumfile")
+	}
+}
+
+// ActionYumfileVerify processes the 'yumfile verify' command
+func ActionYumfileVerify(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if id := context.Args().First(); id != "" {
+		mirror := yumfile.GetRepoByID(id)
 		if mirror == nil {
-			Fatalf(nil, "No such repo found in Yumfile: %s", repo)
+			Exitf(EXIT_CONFIG, nil, "No such repo found in Yumfile: %s", id)
 		}
 
-		if err := yumfile.Sync([]Repo{*mirror}); err != nil {
-			Fatalf(err, "Error syncronizing repo '%s'", mirror.ID)
+		repos = []Repo{*mirror}
+	}
+
+	problems, err := yumfile.Verify(repos)
+	if err != nil {
+		Fatalf(err, "Error verifying repos")
+	}
+
+	if problems > 0 {
+		Exitf(EXIT_VERIFY, nil, "Found %d corrupt or missing packages", problems)
+	}
+}
+
+// ActionYumfileRebuild processes the 'yumfile rebuild' command
+func ActionYumfileRebuild(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if id := context.Args().First(); id != "" {
+		mirror := yumfile.GetRepoByID(id)
+		if mirror == nil {
+			Exitf(EXIT_CONFIG, nil, "No such repo found in Yumfile: %s", id)
 		}
+
+		repos = []Repo{*mirror}
+	}
+
+	// don't rebuild a database while it is being syncronized
+	if err := LockRepos(repos, time.Duration(context.Int("lock-timeout"))*time.Second); err != nil {
+		Fatalf(err, "Failed to acquire lock")
+	}
+	defer ReleaseLock()
+
+	if err := yumfile.Rebuild(repos); err != nil {
+		Fatalf(err, "Error rebuilding repos")
 	}
 }
 
@@ -184,3 +627,31 @@ func PanicOn(err error) {
 func NewErrorf(format string, a ...interface{}) error {
 	return errors.New(fmt.Sprintf(format, a...))
 }
+
+// ExitError is an error which causes Fatalf to exit with the given exit code
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (c *ExitError) Error() string {
+	return c.Err.Error()
+}
+
+// NewExitError associates an exit code with an error
+func NewExitError(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &ExitError{Code: code, Err: err}
+}
+
+// exitCode returns the exit code associated with an error
+func exitCode(err error) int {
+	if e, ok := err.(*ExitError); ok {
+		return e.Code
+	}
+
+	return EXIT_ERROR
+}
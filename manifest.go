@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// writeManifest writes a list of every package in a repo's database to
+// <ManifestDir>/<repo id>.manifest. Each line lists the tab separated name,
+// [epoch:]version-release, architecture, size and checksum of a package, in
+// NEVRA order so manifests may be compared between runs.
+func (c *Yumfile) writeManifest(repo *Repo) error {
+	packages, err := LoadPackages(repo.Path())
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(byNEVRA(packages))
+
+	var buf bytes.Buffer
+	for _, pkg := range packages {
+		evr := pkg.Version.Version + "-" + pkg.Version.Release
+		if pkg.Version.Epoch != "" && pkg.Version.Epoch != "0" {
+			evr = pkg.Version.Epoch + ":" + evr
+		}
+
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%d\t%s:%s\n", pkg.Name, evr, pkg.Arch, pkg.Size.Package, pkg.Checksum.Type, pkg.Checksum.Value)
+	}
+
+	if err := os.MkdirAll(ManifestDir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(ManifestDir, repo.ID+".manifest")
+	Dprintf("Writing package manifest: %s\n", path)
+
+	return WriteFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// byNEVRA sorts packages by name, epoch, version, release and architecture
+type byNEVRA []Package
+
+func (a byNEVRA) Len() int           { return len(a) }
+func (a byNEVRA) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byNEVRA) Less(i, j int) bool { return a[i].NEVRA() < a[j].NEVRA() }
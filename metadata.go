@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Package describes a single package listed in a repository's primary
+// metadata
+type Package struct {
+	Name    string `xml:"name"`
+	Arch    string `xml:"arch"`
+	Version struct {
+		Epoch   string `xml:"epoch,attr"`
+		Version string `xml:"ver,attr"`
+		Release string `xml:"rel,attr"`
+	} `xml:"version"`
+	Checksum struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"checksum"`
+	Size struct {
+		Package int64 `xml:"package,attr"`
+	} `xml:"size"`
+	Location struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+}
+
+type repomd struct {
+	Data []struct {
+		Type     string `xml:"type,attr"`
+		Location struct {
+			Href string `xml:"href,attr"`
+		} `xml:"location"`
+	} `xml:"data"`
+}
+
+// LoadPackages reads the list of packages from the primary metadata of a
+// local repository
+func LoadPackages(repoPath string) ([]Package, error) {
+	packages := make([]Package, 0)
+	err := WalkPackages(repoPath, func(pkg *Package) error {
+		packages = append(packages, *pkg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+// WalkPackages calls fn for each package in the primary metadata of a local
+// repository. The metadata is decoded one package at a time, so memory use
+// does not grow with the size of the repository. If fn returns an error, the
+// walk stops and that error is returned.
+func WalkPackages(repoPath string, fn func(pkg *Package) error) error {
+	// find primary metadata in repomd.xml
+	f, err := os.Open(filepath.Join(repoPath, "repodata", "repomd.xml"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	md := repomd{}
+	if err := xml.NewDecoder(f).Decode(&md); err != nil {
+		return err
+	}
+
+	href := ""
+	for _, data := range md.Data {
+		if data.Type == "primary" {
+			href = data.Location.Href
+		}
+	}
+
+	if href == "" {
+		return NewErrorf("No primary metadata found in %s/repodata/repomd.xml", repoPath)
+	}
+
+	// decode primary metadata
+	pf, err := os.Open(filepath.Join(repoPath, href))
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+
+	var r io.Reader = pf
+	switch {
+	case strings.HasSuffix(href, ".gz"):
+		gz, err := gzip.NewReader(pf)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+
+	case strings.HasSuffix(href, ".xml"):
+		// uncompressed
+
+	default:
+		return NewErrorf("Unsupported primary metadata compression: %s", href)
+	}
+
+	decoder := xml.NewDecoder(r)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "package" {
+			pkg := Package{}
+			if err := decoder.DecodeElement(&pkg, &el); err != nil {
+				return err
+			}
+
+			if err := fn(&pkg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NEVRA returns the name, epoch, version, release and architecture of the
+// package
+func (c *Package) NEVRA() string {
+	epoch := ""
+	if c.Version.Epoch != "" && c.Version.Epoch != "0" {
+		epoch = c.Version.Epoch + ":"
+	}
+
+	return c.Name + "-" + epoch + c.Version.Version + "-" + c.Version.Release + "." + c.Arch
+}
+
+// newHash returns a hash for the given checksum type
+func newHash(checksumType string) (hash.Hash, error) {
+	switch checksumTypes[strings.ToLower(checksumType)] {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+
+	return nil, NewErrorf("Unsupported checksum type: %s", checksumType)
+}
+
+// FileChecksum computes the checksum of a file using the given checksum type
+func FileChecksum(path string, checksumType string) (string, error) {
+	h, err := newHash(checksumType)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
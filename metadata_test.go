@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "y10k-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("y10k\n")
+	f.Close()
+
+	tests := []struct {
+		checksumType string
+		sum          string
+	}{
+		{"md5", "d2885c5ad37293cee8e62f776cbeaf61"},
+		{"sha", "83f169459d4079731e6b20392d03770eeb7863e5"},
+		{"sha1", "83f169459d4079731e6b20392d03770eeb7863e5"},
+		{"sha256", "f22c310b099088d4a59175678d6e2a38356224089a0aa2a3ddf67e99f317e1d9"},
+		{"SHA256", "f22c310b099088d4a59175678d6e2a38356224089a0aa2a3ddf67e99f317e1d9"},
+		{"sha512", "77343facc00570fbd1541874fcdf83a510d7ecfd2eca295cf7afeb07754b1a2e14b86da875ca4053d6e574058a17ea39094901d3e90d3208d4db31fa7ccdb0c7"},
+	}
+
+	for _, test := range tests {
+		sum, err := FileChecksum(f.Name(), test.checksumType)
+		if err != nil {
+			t.Errorf("%s: %s", test.checksumType, err)
+		} else if sum != test.sum {
+			t.Errorf("%s: expected %s, got %s", test.checksumType, test.sum, sum)
+		}
+	}
+
+	if _, err := FileChecksum(f.Name(), "crc32"); err == nil {
+		t.Errorf("expected an error for an unsupported checksum type")
+	}
+}
+
+func TestRepoChecksumOption(t *testing.T) {
+	tests := map[string]string{
+		"md5":    "md5",
+		"SHA":    "sha1",
+		"sha1":   "sha1",
+		"Sha256": "sha256",
+		"sha512": "sha512",
+		"crc32":  "",
+	}
+
+	c := &Yumfile{}
+	for val, want := range tests {
+		repo := NewRepo()
+		if err := c.setRepoOption(repo, "checksum", val, "Yumfile", 1); err != nil {
+			t.Errorf("%s: %s", val, err)
+		} else if repo.Checksum != want {
+			t.Errorf("%s: expected %q, got %q", val, want, repo.Checksum)
+		}
+	}
+}
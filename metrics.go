@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metric describes a metric written to a Prometheus textfile
+type metric struct {
+	name  string
+	help  string
+	value func(stats *RepoStats) float64
+}
+
+var metrics = []metric{
+	{"y10k_last_sync_timestamp", "Unix time at which the repo was last syncronized", nil},
+	{"y10k_packages_downloaded_total", "Number of packages downloaded in the last sync", func(stats *RepoStats) float64 {
+		return float64(stats.Downloaded)
+	}},
+	{"y10k_packages_deleted_total", "Number of packages deleted in the last sync", func(stats *RepoStats) float64 {
+		return float64(stats.Deleted)
+	}},
+	{"y10k_download_bytes_total", "Bytes downloaded in the last sync", func(stats *RepoStats) float64 {
+		return float64(stats.Bytes)
+	}},
+	{"y10k_download_failures_total", "1 if the last sync of the repo failed, otherwise 0", func(stats *RepoStats) float64 {
+		if stats.Error != "" {
+			return 1
+		}
+		return 0
+	}},
+	{"y10k_sync_duration_seconds", "Duration of the last sync in seconds", func(stats *RepoStats) float64 {
+		return stats.Elapsed
+	}},
+	{"y10k_sync_attempts", "Number of times reposync was run in the last sync", func(stats *RepoStats) float64 {
+		return float64(stats.Attempts)
+	}},
+}
+
+// WriteMetrics writes the stats of a sync run to a file in the Prometheus
+// text exposition format, as read by the node_exporter textfile collector
+func WriteMetrics(path string, stats []RepoStats) error {
+	now := float64(time.Now().Unix())
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", m.name)
+		for i := range stats {
+			val := now
+			if m.value != nil {
+				val = m.value(&stats[i])
+			}
+
+			fmt.Fprintf(&buf, "%s{repo=\"%s\"} %s\n", m.name, escapeLabel(stats[i].ID), strconv.FormatFloat(val, 'f', -1, 64))
+		}
+	}
+
+	return WriteFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(s)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcEntry is the login and password of a machine in a netrc file
+type netrcEntry struct {
+	Login    string
+	Password string
+}
+
+// parseNetrc reads the machine entries of a netrc file, keyed by host name.
+// The default entry, if any, is keyed by an empty string. Macro definitions
+// are ignored.
+func parseNetrc(path string) (map[string]netrcEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]netrcEntry, 0)
+	machine := ""
+	inEntry := false
+	inMacro := false
+	entry := netrcEntry{}
+
+	save := func() {
+		if inEntry {
+			if _, ok := entries[machine]; !ok {
+				entries[machine] = entry
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// macro definitions end at the next blank line
+		if inMacro {
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+
+		// a '#' may appear in a password, so only whole lines are comments
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		tokens := strings.Fields(line)
+		for i := 0; i < len(tokens); i++ {
+			next := ""
+			if i+1 < len(tokens) {
+				next = tokens[i+1]
+			}
+
+			switch tokens[i] {
+			case "machine":
+				save()
+				machine, entry, inEntry = next, netrcEntry{}, true
+				i++
+
+			case "default":
+				save()
+				machine, entry, inEntry = "", netrcEntry{}, true
+
+			case "login":
+				entry.Login = next
+				i++
+
+			case "password":
+				entry.Password = next
+				i++
+
+			case "account":
+				i++
+
+			case "macdef":
+				save()
+				inEntry = false
+				inMacro = true
+				i = len(tokens)
+			}
+		}
+	}
+	save()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// netrcPath returns the path of the netrc file to read credentials from
+func netrcPath() string {
+	if NetrcPath != "" {
+		return NetrcPath
+	}
+
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".netrc")
+	}
+
+	return ""
+}
+
+// applyNetrc sets the username and password of each repo which has none from
+// the netrc entry of the host of its upstream URLs, or the default entry.
+func (c *Yumfile) applyNetrc() error {
+	path := netrcPath()
+	if path == "" {
+		return nil
+	}
+
+	entries, err := parseNetrc(path)
+	if err != nil {
+		// the default netrc file is optional
+		if os.IsNotExist(err) && NetrcPath == "" {
+			return nil
+		}
+
+		return err
+	}
+
+	for i := range c.Repos {
+		repo := &c.Repos[i]
+		if repo.Parameters["username"] != "" || repo.Parameters["password"] != "" {
+			continue
+		}
+
+		if entry, ok := netrcEntryFor(repo, entries); ok {
+			Dprintf("Using credentials from %s for %s\n", path, repo.ID)
+			repo.Parameters["username"] = entry.Login
+			repo.Parameters["password"] = entry.Password
+		}
+	}
+
+	return nil
+}
+
+// netrcEntryFor returns the netrc entry to use for a repo. yum sends the
+// credentials of a repo to every server it downloads from, so an entry is
+// only used if every baseurl of the repo is on the same host. Repos with a
+// mirrorlist or metalink are never given credentials, as their mirrors are
+// not known in advance.
+func netrcEntryFor(repo *Repo, entries map[string]netrcEntry) (netrcEntry, bool) {
+	if repo.Parameters["mirrorlist"] != "" || repo.Parameters["metalink"] != "" {
+		return netrcEntry{}, false
+	}
+
+	host := ""
+	for _, rawurl := range strings.Fields(repo.Parameters["baseurl"]) {
+		u, err := url.Parse(rawurl)
+		if err != nil || u.Host == "" {
+			return netrcEntry{}, false
+		}
+
+		h := u.Host
+		if i := strings.LastIndex(h, ":"); i >= 0 && !strings.HasSuffix(h, "]") {
+			h = h[:i]
+		}
+
+		if host != "" && h != host {
+			return netrcEntry{}, false
+		}
+
+		host = h
+	}
+
+	if host == "" {
+		return netrcEntry{}, false
+	}
+
+	entry, ok := entries[host]
+	if !ok {
+		entry, ok = entries[""]
+	}
+
+	return entry, ok && entry.Login != ""
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writeNetrc writes a netrc file to a temporary path and returns its path
+func writeNetrc(t *testing.T, s string) string {
+	f, err := ioutil.TempFile("", "y10k-netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString(s)
+	f.Close()
+
+	return f.Name()
+}
+
+func TestParseNetrc(t *testing.T) {
+	path := writeNetrc(t, `# comment line
+  # indented comment
+machine one.example.com login alice password s3cr#t
+
+machine two.example.com
+	login bob
+	account ignored
+	password hunter2
+
+macdef init
+machine macro.example.com login mallory password x
+
+machine three.example.com login carol password c
+default login anonymous password guest#1
+`)
+	defer os.Remove(path)
+
+	entries, err := parseNetrc(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host  string
+		entry netrcEntry
+	}{
+		{"one.example.com", netrcEntry{"alice", "s3cr#t"}},
+		{"two.example.com", netrcEntry{"bob", "hunter2"}},
+		{"three.example.com", netrcEntry{"carol", "c"}},
+		{"", netrcEntry{"anonymous", "guest#1"}},
+	}
+
+	for _, test := range tests {
+		if entry, ok := entries[test.host]; !ok {
+			t.Errorf("no entry parsed for %q", test.host)
+		} else if entry != test.entry {
+			t.Errorf("%q: expected %+v, got %+v", test.host, test.entry, entry)
+		}
+	}
+
+	if _, ok := entries["macro.example.com"]; ok {
+		t.Errorf("parsed an entry from a macro definition")
+	}
+
+	if len(entries) != len(tests) {
+		t.Errorf("expected %d entries, got %d: %+v", len(tests), len(entries), entries)
+	}
+}
+
+func TestNetrcEntryFor(t *testing.T) {
+	entries := map[string]netrcEntry{
+		"repo.example.com": {"alice", "secret"},
+	}
+
+	withDefault := map[string]netrcEntry{
+		"repo.example.com": {"alice", "secret"},
+		"":                 {"anonymous", "guest"},
+	}
+
+	tests := []struct {
+		params  map[string]string
+		entries map[string]netrcEntry
+		login   string
+	}{
+		// single baseurl
+		{map[string]string{"baseurl": "http://repo.example.com/a"}, entries, "alice"},
+
+		// port is ignored
+		{map[string]string{"baseurl": "https://repo.example.com:8443/a"}, entries, "alice"},
+
+		// every baseurl on the matched host
+		{map[string]string{"baseurl": "http://repo.example.com/a http://repo.example.com/b"}, entries, "alice"},
+
+		// credentials must not be sent to an unrelated host
+		{map[string]string{"baseurl": "http://repo.example.com/a http://public.example.org/a"}, entries, ""},
+		{map[string]string{"baseurl": "http://public.example.org/a http://repo.example.com/a"}, withDefault, ""},
+
+		// mirrors are not known in advance
+		{map[string]string{"mirrorlist": "http://repo.example.com/mirrorlist"}, entries, ""},
+		{map[string]string{"metalink": "http://repo.example.com/metalink"}, entries, ""},
+		{map[string]string{"baseurl": "http://repo.example.com/a", "mirrorlist": "http://repo.example.com/mirrorlist"}, entries, ""},
+
+		// default entry
+		{map[string]string{"baseurl": "http://other.example.com/a"}, entries, ""},
+		{map[string]string{"baseurl": "http://other.example.com/a"}, withDefault, "anonymous"},
+		{map[string]string{"baseurl": "http://repo.example.com/a"}, withDefault, "alice"},
+
+		// local repos
+		{map[string]string{"baseurl": "file:///srv/repo"}, withDefault, ""},
+	}
+
+	for _, test := range tests {
+		repo := &Repo{ID: "test", Parameters: test.params}
+		entry, ok := netrcEntryFor(repo, test.entries)
+		if test.login == "" && ok {
+			t.Errorf("%v: expected no credentials, got %s", test.params, entry.Login)
+		} else if test.login != "" && (!ok || entry.Login != test.login) {
+			t.Errorf("%v: expected login %s, got %s", test.params, test.login, entry.Login)
+		}
+	}
+}
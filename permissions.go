@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseOwner parses an owner in the form user[:group] where user is a user
+// name or numeric UID and group is a numeric GID. If no group is given, the
+// primary group of a named user is used, otherwise the group is unchanged (-1).
+func parseOwner(s string) (int, int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	uid, gid := -1, -1
+
+	if n, err := strconv.Atoi(parts[0]); err == nil {
+		uid = n
+	} else {
+		u, err := user.Lookup(parts[0])
+		if err != nil {
+			return -1, -1, NewErrorf("Unknown user: %s", parts[0])
+		}
+
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return -1, -1, NewErrorf("Invalid group ID: %s", parts[1])
+		}
+
+		gid = n
+	}
+
+	return uid, gid, nil
+}
+
+// applyPermissions sets the configured mode and ownership of every file and
+// directory in a repo's local mirror. Modes are set explicitly so they do not
+// depend on the umask. Changing ownership usually requires root.
+func (c *Yumfile) applyPermissions(repo *Repo) error {
+	if repo.FileMode == 0 && repo.DirMode == 0 && repo.UID < 0 && repo.GID < 0 {
+		return nil
+	}
+
+	Dprintf("Setting permissions for %s\n", repo.ID)
+
+	root := repo.Path()
+	if target, err := filepath.EvalSymlinks(root); err == nil {
+		root = target
+	}
+
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		mode := repo.FileMode
+		if fi.IsDir() {
+			mode = repo.DirMode
+		}
+
+		if mode != 0 && fi.Mode().Perm() != mode {
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		}
+
+		if repo.UID >= 0 || repo.GID >= 0 {
+			if err := os.Lchown(path, repo.UID, repo.GID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PackageInfo describes a package in the output of 'yumfile list --json'
+type PackageInfo struct {
+	Name    string `json:"name"`
+	Epoch   string `json:"epoch"`
+	Version string `json:"version"`
+	Release string `json:"release"`
+	Arch    string `json:"arch"`
+	Size    int64  `json:"size"`
+}
+
+// QueryPackages returns the packages available in an upstream repo using
+// repoquery. Only the repo metadata is downloaded. The include, exclude and
+// architecture filters of the repo are applied.
+func (c *Yumfile) QueryPackages(repo *Repo) ([]Package, error) {
+	if err := c.installYumConf(repo); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		fmt.Sprintf("--config=%s", c.yumConfPath(repo)),
+		fmt.Sprintf("--repoid=%s", repo.ID),
+		"--all",
+		"--queryformat=%{name}\t%{epoch}\t%{version}\t%{release}\t%{arch}\t%{packagesize}",
+	}
+
+	if !repo.NewOnly {
+		args = append(args, "--show-duplicates")
+	}
+
+	if len(repo.Architectures) > 0 {
+		arches := append([]string{}, repo.Architectures...)
+		if !containsString(arches, "noarch") {
+			arches = append(arches, "noarch")
+		}
+
+		args = append(args, fmt.Sprintf("--archlist=%s", strings.Join(arches, ",")))
+	}
+
+	packages := make([]Package, 0)
+	var perr error = nil
+	handler := func(line string) {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 {
+			Dprintf("%s: repoquery: %s\n", repo.ID, line)
+			return
+		}
+
+		size, err := strconv.ParseInt(fields[5], 10, 64)
+		if err != nil && perr == nil {
+			perr = NewErrorf("Invalid package size from repoquery: %s", line)
+		}
+
+		pkg := Package{Name: fields[0], Arch: fields[4]}
+		pkg.Version.Epoch = fields[1]
+		pkg.Version.Version = fields[2]
+		pkg.Version.Release = fields[3]
+		pkg.Size.Package = size
+		packages = append(packages, pkg)
+	}
+
+	if err := ExecLines(repo.ID, handler, "repoquery", args...); err != nil {
+		return nil, err
+	}
+
+	if perr != nil {
+		return nil, perr
+	}
+
+	sort.Sort(byNEVRA(packages))
+	return packages, nil
+}
+
+// PrintPackages prints a list of packages to STDOUT as text or JSON
+func PrintPackages(packages []Package, asJSON bool) error {
+	if !asJSON {
+		for _, pkg := range packages {
+			Outputf("%s %s\n", pkg.NEVRA(), bytesToStr(pkg.Size.Package))
+		}
+
+		return nil
+	}
+
+	infos := make([]PackageInfo, len(packages))
+	for i, pkg := range packages {
+		infos[i] = PackageInfo{
+			Name:    pkg.Name,
+			Epoch:   pkg.Version.Epoch,
+			Version: pkg.Version.Version,
+			Release: pkg.Version.Release,
+			Arch:    pkg.Arch,
+			Size:    pkg.Size.Package,
+		}
+	}
+
+	b, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", b)
+	return err
+}
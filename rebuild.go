@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+)
+
+// Rebuild recreates the database of the local mirror of each given repo from
+// the packages found on disk. The checksum and size of every package is read
+// again, so packages which have been added, removed or replaced by hand are
+// indexed correctly. No upstream repositories are contacted.
+func (c *Yumfile) Rebuild(repos []Repo) error {
+	for _, repo := range repos {
+		Printf("Rebuilding repo: %s\n", repo.ID)
+
+		if _, err := os.Stat(repo.Path()); err != nil {
+			return NewExitError(EXIT_CONFIG, NewErrorf("No local mirror found for %s: %s", repo.ID, err.Error()))
+		}
+
+		if err := c.createrepo(&repo, false); err != nil {
+			return NewErrorf("Failed to update repo database for %s: %s", repo.ID, err.Error())
+		}
+
+		if err := c.modifyrepo(&repo); err != nil {
+			return NewErrorf("Failed to add module metadata to repo database for %s: %s", repo.ID, err.Error())
+		}
+
+		if err := c.applyPermissions(&repo); err != nil {
+			return NewExitError(EXIT_DISK, NewErrorf("Failed to set permissions for %s: %s", repo.ID, err.Error()))
+		}
+	}
+
+	return nil
+}
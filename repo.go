@@ -1,5 +1,11 @@
 package main
 
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
 type Repo struct {
 	ID             string
 	Parameters     map[string]string
@@ -10,27 +16,120 @@ type Repo struct {
 	NewOnly        bool
 	DeleteRemoved  bool
 	GPGCheck       bool
+	RepoGPGCheck   bool
+	RequireSigned  bool
+	FailUnsigned   bool
+	Enabled        bool
 	Architecture   string
+	Architectures  []string
 	YumfilePath    string
 	YumfileLineNo  int
 	Checksum       string
 	Groupfile      string
+	Deltas         bool
+	FileMode       os.FileMode
+	DirMode        os.FileMode
+	UID            int
+	GID            int
+	PostSync       string
+	GPGKeys        []string
+	SSLVerify      bool
+	SSLCACert      string
+	SSLClientCert  string
+	SSLClientKey   string
 }
 
 func NewRepo() *Repo {
 	return &Repo{
 		Parameters: make(map[string]string, 0),
+		SSLVerify:  true,
+		Enabled:    true,
+		UID:        -1,
+		GID:        -1,
+	}
+}
+
+// AppendParameter appends a space separated value to a yum repo parameter
+func (c *Repo) AppendParameter(key, val string) {
+	if c.Parameters[key] != "" {
+		c.Parameters[key] += " " + val
+	} else {
+		c.Parameters[key] = val
 	}
 }
 
+// Path returns the local path the repo is mirrored to
+func (c *Repo) Path() string {
+	if c.LocalPath != "" {
+		return c.LocalPath
+	}
+
+	return fmt.Sprintf("./%s", c.ID)
+}
+
+// Validate ensures the repo fields contain valid values
 func (c *Repo) Validate() error {
+	if problems := c.Problems(); len(problems) > 0 {
+		return problems[0]
+	}
+
+	return nil
+}
+
+// Problems returns every invalid value found in the repo definition
+func (c *Repo) Problems() []error {
+	problems := make([]error, 0)
+
 	if c.ID == "" {
-		return NewErrorf("Upstream repository has no ID specified (in %s:%d)", c.YumfilePath, c.YumfileLineNo)
+		problems = append(problems, NewErrorf("Upstream repository has no ID specified (in %s:%d)", c.YumfilePath, c.YumfileLineNo))
 	}
 
-	if c.Parameters["mirrorlist"] == "" && c.Parameters["baseurl"] == "" {
-		return NewErrorf("Upstream repository for '%s' has no mirror list or base URL (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+	if c.Parameters["mirrorlist"] == "" && c.Parameters["metalink"] == "" && c.Parameters["baseurl"] == "" {
+		problems = append(problems, NewErrorf("Upstream repository for '%s' has no mirror list, metalink or base URL (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo))
 	}
 
-	return nil
+	for _, u := range strings.Fields(c.Parameters["baseurl"]) {
+		if strings.HasPrefix(u, "file://") {
+			if _, err := os.Stat(strings.TrimPrefix(u, "file://")); err != nil {
+				problems = append(problems, NewErrorf("Local base URL for '%s' is not accessible: %s (in %s:%d)", c.ID, err.Error(), c.YumfilePath, c.YumfileLineNo))
+			}
+		}
+	}
+
+	if c.GPGCheck && len(c.GPGKeys) == 0 {
+		problems = append(problems, NewErrorf("Upstream repository for '%s' has gpgcheck enabled but no gpgkey (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo))
+	}
+
+	if c.RepoGPGCheck && len(c.GPGKeys) == 0 {
+		problems = append(problems, NewErrorf("Upstream repository for '%s' has repo_gpgcheck enabled but no gpgkey (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo))
+	}
+
+	for _, key := range c.GPGKeys {
+		if strings.HasPrefix(key, "file://") {
+			if _, err := os.Stat(strings.TrimPrefix(key, "file://")); err != nil {
+				problems = append(problems, NewErrorf("GPG key for '%s' is not accessible: %s (in %s:%d)", c.ID, err.Error(), c.YumfilePath, c.YumfileLineNo))
+			}
+		}
+	}
+
+	if c.SSLClientKey != "" && c.SSLClientCert == "" {
+		problems = append(problems, NewErrorf("Upstream repository for '%s' has an SSL client key but no client certificate (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo))
+	}
+
+	sslFiles := [][2]string{
+		{"CA certificate", c.SSLCACert},
+		{"client certificate", c.SSLClientCert},
+		{"client key", c.SSLClientKey},
+	}
+
+	for _, f := range sslFiles {
+		desc, path := f[0], f[1]
+		if path != "" {
+			if _, err := os.Stat(path); err != nil {
+				problems = append(problems, NewErrorf("SSL %s for '%s' is not accessible: %s (in %s:%d)", desc, c.ID, err.Error(), c.YumfilePath, c.YumfileLineNo))
+			}
+		}
+	}
+
+	return problems
 }
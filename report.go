@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// RepoStats describes the outcome of syncronizing a single repo
+type RepoStats struct {
+	ID         string  `json:"id"`
+	Downloaded int     `json:"downloaded"`
+	Skipped    int     `json:"skipped"`
+	Deleted    int     `json:"deleted"`
+	Bytes      int64   `json:"bytes"`
+	Elapsed    float64 `json:"elapsed_seconds"`
+	Attempts   int     `json:"attempts"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// SyncReport is the machine readable summary of a sync run
+type SyncReport struct {
+	Timestamp string      `json:"timestamp"`
+	Repos     []RepoStats `json:"repos"`
+}
+
+// NewRepoStats computes the stats of a syncronized repo by comparing snapshots
+// of its packages taken before and after the sync. Packages which are new or
+// have changed are counted as downloaded. attempts is the number of times
+// reposync was run.
+func NewRepoStats(repo *Repo, before, after map[string]os.FileInfo, elapsed time.Duration, attempts int, err error) RepoStats {
+	stats := RepoStats{
+		ID:       repo.ID,
+		Elapsed:  elapsed.Seconds(),
+		Attempts: attempts,
+	}
+
+	if err != nil {
+		stats.Error = err.Error()
+	}
+
+	for path, fi := range after {
+		if prev, ok := before[path]; ok && prev.Size() == fi.Size() && prev.ModTime().Equal(fi.ModTime()) {
+			stats.Skipped++
+		} else {
+			stats.Downloaded++
+		}
+	}
+	stats.Bytes = changedBytes(before, after)
+
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			stats.Deleted++
+		}
+	}
+
+	return stats
+}
+
+// changedBytes returns the total size of the packages which are new or have
+// changed between two snapshots
+func changedBytes(before, after map[string]os.FileInfo) int64 {
+	n := int64(0)
+	for path, fi := range after {
+		if prev, ok := before[path]; !ok || prev.Size() != fi.Size() || !prev.ModTime().Equal(fi.ModTime()) {
+			n += fi.Size()
+		}
+	}
+
+	return n
+}
+
+// WriteReport writes a JSON summary of a sync run to the given path, or to
+// STDOUT if the path is "-"
+func WriteReport(path string, stats []RepoStats) error {
+	report := SyncReport{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Repos:     stats,
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if path == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+
+	return WriteFileAtomic(path, b, 0644)
+}
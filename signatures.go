@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// signatureTags are the RPM header tags which hold a package signature. A
+// package with none of these tags is unsigned.
+var signatureTags = []string{"RSAHEADER", "DSAHEADER", "SIGPGP", "SIGGPG"}
+
+// checkSignatures ensures that every package in the local mirror of a repo is
+// signed, including packages downloaded before requiresigned was enabled.
+// Unsigned packages are removed from the local mirror so they are never added
+// to its database. If failunsigned is set, the repo fails if any are found.
+// Packages with a bad signature are left to the gpgcheck option. Results are
+// kept in the checksum cache so that unchanged packages are only read once.
+func (c *Yumfile) checkSignatures(repo *Repo) error {
+	paths := make([]string, 0)
+	for path := range snapshotPackages(repo.Path()) {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	unsigned := 0
+	for _, path := range paths {
+		path = filepath.Join(repo.Path(), path)
+		signed, err := CachedIsSigned(path, func(path string) (bool, error) {
+			return isSigned(repo, path)
+		})
+		if err != nil {
+			return NewErrorf("Failed to read signature of %s: %s", path, err.Error())
+		}
+
+		if !signed {
+			unsigned++
+			Errorf(nil, "Removing unsigned package from %s: %s", repo.ID, path)
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := SaveChecksumCache(); err != nil {
+		Errorf(err, "Failed to save checksum cache")
+	}
+
+	if unsigned > 0 && repo.FailUnsigned {
+		return NewErrorf("Found %d unsigned packages", unsigned)
+	}
+
+	return nil
+}
+
+// isSigned returns true if the header of the given package file contains a
+// signature. The signature itself is not verified.
+func isSigned(repo *Repo, path string) (bool, error) {
+	formats := make([]string, len(signatureTags))
+	for i, tag := range signatureTags {
+		formats[i] = "%{" + tag + ":pgpsig}"
+	}
+
+	signed := false
+	err := ExecLines(repo.ID, func(line string) {
+		for _, sig := range strings.Split(line, "\t") {
+			if sig != "" && sig != "(none)" {
+				signed = true
+			}
+		}
+	}, "rpm", "-qp", "--nosignature", "--nodigest", "--queryformat="+strings.Join(formats, "\t")+"\n", path)
+
+	return signed, err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stagingDirs are the staging directories of repos currently being
+// syncronized, so that they may be removed if y10k is interrupted
+var stagingDirs = make(map[string]bool, 0)
+var stagingLock sync.Mutex
+
+var stagingPattern = regexp.MustCompile("^\\..+\\.\\d+$")
+
+// syncStaged syncronizes a repo into a staging copy of its local mirror and,
+// if the sync succeeds, replaces the local mirror with the staging copy. The
+// local mirror becomes a symlink to the current copy so that it may be
+// replaced atomically. If the sync fails, the local mirror is untouched. The
+// number of times reposync was run is returned with any error.
+func (c *Yumfile) syncStaged(repo *Repo, before map[string]os.FileInfo) (int, error) {
+	live := filepath.Clean(repo.Path())
+	removeStaleStaging(live)
+
+	staged := *repo
+	staged.LocalPath = filepath.Join(filepath.Dir(live), fmt.Sprintf(".%s.%d", filepath.Base(live), time.Now().UnixNano()))
+
+	stagingLock.Lock()
+	stagingDirs[staged.LocalPath] = true
+	stagingLock.Unlock()
+	defer removeStaging(staged.LocalPath)
+
+	Dprintf("Staging %s in %s\n", repo.ID, staged.LocalPath)
+	if err := copyTree(live, staged.LocalPath); err != nil {
+		Errorf(err, "Failed to create staging directory for %s", repo.ID)
+		return 0, NewExitError(EXIT_DISK, err)
+	}
+
+	attempts, err := c.syncRepo(&staged, before)
+	if err != nil {
+		return attempts, err
+	}
+
+	// the staging directory becomes the live mirror and must not be removed
+	// by an interrupt once promoted
+	stagingLock.Lock()
+	err = promote(live, staged.LocalPath)
+	if err == nil {
+		delete(stagingDirs, staged.LocalPath)
+	}
+	stagingLock.Unlock()
+
+	if err != nil {
+		Errorf(err, "Failed to promote staging directory for %s", repo.ID)
+		return attempts, NewExitError(EXIT_DISK, err)
+	}
+
+	Printf("Promoted staged repo: %s\n", repo.ID)
+	return attempts, nil
+}
+
+// removeStaging removes a staging directory if it has not been promoted
+func removeStaging(path string) {
+	stagingLock.Lock()
+	defer stagingLock.Unlock()
+
+	if stagingDirs[path] {
+		os.RemoveAll(path)
+		delete(stagingDirs, path)
+	}
+}
+
+// RemoveStaging removes the staging directories of all repos being
+// syncronized. It is called when y10k is interrupted.
+func RemoveStaging() {
+	stagingLock.Lock()
+	defer stagingLock.Unlock()
+
+	for path := range stagingDirs {
+		Printf("Removing staging directory %s\n", path)
+		os.RemoveAll(path)
+		delete(stagingDirs, path)
+	}
+}
+
+// removeStaleStaging removes staging directories left next to a local mirror
+// by a sync which was killed. The caller must hold the lock of the mirror.
+func removeStaleStaging(live string) {
+	current := ""
+	if target, err := os.Readlink(live); err == nil {
+		current = filepath.Base(target)
+	}
+
+	base := "." + filepath.Base(live) + "."
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(live), base+"*"))
+	for _, path := range matches {
+		name := filepath.Base(path)
+		if name != current && stagingPattern.MatchString(name) && strings.HasPrefix(name, base) {
+			Dprintf("Removing stale staging directory %s\n", path)
+			os.RemoveAll(path)
+		}
+	}
+}
+
+// copyTree recreates the directory tree of src in dst. Packages are hardlinked
+// to the original, so that unchanged packages need not be downloaded again.
+// All other files are copied, because reposync rewrites metadata such as
+// comps.xml in place, which would modify the live mirror through a shared
+// inode. Only dst is created if src does not exist.
+func copyTree(src, dst string) error {
+	if target, err := filepath.EvalSymlinks(src); err == nil {
+		src = target
+	} else if os.IsNotExist(err) {
+		return os.MkdirAll(dst, 0755)
+	} else {
+		return err
+	}
+
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+
+		case fi.Mode().IsRegular() && strings.HasSuffix(path, ".rpm"):
+			return os.Link(path, target)
+
+		case fi.Mode().IsRegular():
+			return copyFile(path, target, fi)
+		}
+
+		return nil
+	})
+}
+
+// copyFile copies a file, keeping its mode and modification time so that
+// createrepo --checkts sees it as unchanged
+func copyFile(src, dst string, fi os.FileInfo) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// promote atomically replaces the symlink at the live path with a symlink to
+// the staged directory and removes the previous directory. If the live path
+// is a directory, it is first replaced with a symlink, leaving the path briefly
+// unavailable.
+func promote(live, staged string) error {
+	tmp := live + ".y10k-link"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(staged), tmp); err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(live)
+	switch {
+	case os.IsNotExist(err):
+		return os.Rename(tmp, live)
+
+	case err != nil:
+		os.Remove(tmp)
+		return err
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		prev, err := os.Readlink(live)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+
+		if err := os.Rename(tmp, live); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+
+		// only remove previous copies created by y10k
+		if !filepath.IsAbs(prev) && strings.HasPrefix(prev, "."+filepath.Base(live)+".") {
+			return os.RemoveAll(filepath.Join(filepath.Dir(live), prev))
+		}
+
+		return nil
+
+	default:
+		Printf("Converting %s to a symlink to its staged copy\n", live)
+		old := live + ".y10k-old"
+		if err := os.Rename(live, old); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+
+		if err := os.Rename(tmp, live); err != nil {
+			os.Rename(old, live)
+			os.Remove(tmp)
+			return err
+		}
+
+		return os.RemoveAll(old)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os"
+)
+
+// isWritable returns true if the given directory is not read-only
+func isWritable(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.Mode().Perm()&0200 != 0
+}
+
+// sameDevice always returns false as the filesystem of a file cannot be
+// determined on this platform
+func sameDevice(a, b os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,31 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// isWritable returns true if the current user may create files in the given
+// directory
+func isWritable(dir string) bool {
+	// W_OK is not defined by the syscall package on all platforms
+	return syscall.Access(dir, 0x2) == nil
+}
+
+// sameDevice returns true if both files are on the same filesystem
+func sameDevice(a, b os.FileInfo) bool {
+	sa, ok := a.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	sb, ok := b.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	return sa.Dev == sb.Dev
+}
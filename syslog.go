@@ -0,0 +1,73 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+var syslogWriter *syslog.Writer = nil
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// initSyslog connects to the system logger using the named facility
+func initSyslog(facility string) error {
+	priority, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return NewErrorf("Unrecognized syslog facility: %s", facility)
+	}
+
+	w, err := syslog.New(priority|syslog.LOG_INFO, "y10k")
+	if err != nil {
+		return err
+	}
+
+	syslogWriter = w
+	return nil
+}
+
+// closeSyslog closes the connection to the system logger
+func closeSyslog() {
+	if syslogWriter != nil {
+		syslogWriter.Close()
+		syslogWriter = nil
+	}
+}
+
+// syslogf writes a message to the system logger with a severity matching the
+// given log category
+func syslogf(category int, msg string) {
+	switch category {
+	case LOG_CAT_ERROR:
+		syslogWriter.Err(msg)
+	case LOG_CAT_WARN:
+		syslogWriter.Warning(msg)
+	case LOG_CAT_DEBUG:
+		syslogWriter.Debug(msg)
+	default:
+		syslogWriter.Info(msg)
+	}
+}
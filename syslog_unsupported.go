@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// initSyslog always fails as syslog is not available on this platform
+func initSyslog(facility string) error {
+	return NewErrorf("Logging to syslog is not supported on this platform")
+}
+
+func closeSyslog() {}
+
+func syslogf(category int, msg string) {}
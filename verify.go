@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Verify validates the checksum of every package in the local mirror of each
+// given repo against the mirror's metadata and returns the number of corrupt
+// or missing packages found
+func (c *Yumfile) Verify(repos []Repo) (int, error) {
+	problems := 0
+	for _, repo := range repos {
+		Printf("Verifying repo: %s\n", repo.ID)
+
+		valid, corrupt, missing, err := c.verifyRepo(&repo)
+		if err != nil {
+			return problems, err
+		}
+
+		Printf("%s: %d valid, %d corrupt, %d missing\n", repo.ID, valid, corrupt, missing)
+		problems += corrupt + missing
+	}
+
+	if err := SaveChecksumCache(); err != nil {
+		Errorf(err, "Failed to save checksum cache")
+	}
+
+	return problems, nil
+}
+
+// verifyRepo validates the packages of a single repo. Packages are verified
+// as they are read from the metadata, so verification of a large repo starts
+// before its metadata has been read entirely.
+func (c *Yumfile) verifyRepo(repo *Repo) (valid, corrupt, missing int, err error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan Package)
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range ch {
+				path := filepath.Join(repo.Path(), pkg.Location.Href)
+				sum, err := CachedFileChecksum(path, pkg.Checksum.Type)
+
+				mu.Lock()
+				switch {
+				case os.IsNotExist(err):
+					missing++
+					Errorf(nil, "Missing package in %s: %s", repo.ID, path)
+
+				case err != nil:
+					corrupt++
+					Errorf(err, "Failed to validate package in %s: %s", repo.ID, path)
+
+				case sum != strings.ToLower(strings.TrimSpace(pkg.Checksum.Value)):
+					corrupt++
+					Errorf(nil, "Checksum mismatch for package in %s: %s", repo.ID, path)
+
+				default:
+					valid++
+					Dprintf("Valid: %s\n", path)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = WalkPackages(repo.Path(), func(pkg *Package) error {
+		ch <- *pkg
+		return nil
+	})
+	close(ch)
+	wg.Wait()
+
+	return valid, corrupt, missing, err
+}
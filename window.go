@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var windowPattern = regexp.MustCompile("^(\\d{1,2}):(\\d{2})-(\\d{1,2}):(\\d{2})$")
+
+// TimeWindow is a daily period of local time in which repos may be
+// syncronized. The window may span midnight.
+type TimeWindow struct {
+	Start int // minutes after midnight
+	End   int // minutes after midnight
+}
+
+// ParseTimeWindow parses a time window in the form HH:MM-HH:MM
+func ParseTimeWindow(s string) (*TimeWindow, error) {
+	matches := windowPattern.FindAllStringSubmatch(s, -1)
+	if len(matches) == 0 {
+		return nil, NewErrorf("Invalid sync window: %s (expected HH:MM-HH:MM)", s)
+	}
+
+	mins := make([]int, 2)
+	for i := 0; i < 2; i++ {
+		h, _ := strconv.Atoi(matches[0][1+i*2])
+		m, _ := strconv.Atoi(matches[0][2+i*2])
+		if h > 23 || m > 59 {
+			return nil, NewErrorf("Invalid sync window: %s", s)
+		}
+
+		mins[i] = h*60 + m
+	}
+
+	if mins[0] == mins[1] {
+		return nil, NewErrorf("Invalid sync window: %s (start and end are the same)", s)
+	}
+
+	return &TimeWindow{Start: mins[0], End: mins[1]}, nil
+}
+
+func (c *TimeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", c.Start/60, c.Start%60, c.End/60, c.End%60)
+}
+
+// Contains returns true if the given time falls within the window
+func (c *TimeWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if c.Start < c.End {
+		return m >= c.Start && m < c.End
+	}
+
+	return m >= c.Start || m < c.End
+}
+
+// Next returns the time at which the window next opens after the given time
+func (c *TimeWindow) Next(t time.Time) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), c.Start/60, c.Start%60, 0, 0, t.Location())
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next
+}
+
+// Wait blocks until the window is open. Repos already being syncronized are
+// not interrupted when the window closes.
+func (c *TimeWindow) Wait(id string) {
+	now := time.Now()
+	if c.Contains(now) {
+		return
+	}
+
+	next := c.Next(now)
+	Printf("Outside of sync window %s. Waiting until %s to syncronize %s...\n", c, next.Format("2006-01-02 15:04"), id)
+	time.Sleep(next.Sub(now))
+}
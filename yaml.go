@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// isYAML returns true if a Yumfile should be parsed as YAML. The format of the
+// top-level Yumfile may be set with --format, otherwise the format is detected
+// from the file extension.
+func isYAML(path string, toplevel bool) bool {
+	if toplevel && YumfileFormat != "auto" {
+		return YumfileFormat == "yaml"
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// loadYAML parses a YAML formatted Yumfile and appends its repos and settings
+// to the Yumfile. Keys and values are the same as those of the standard
+// Yumfile format, with repos defined as a map of repo IDs to options. Any value
+// may also be given as a list, which is joined with spaces.
+func (c *Yumfile) loadYAML(r io.Reader, path string, stack []string) error {
+	syntaxError := func(node *yaml.Node, format string, a ...interface{}) {
+		c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: %s", path, node.Line, fmt.Sprintf(format, a...)))
+	}
+
+	doc := yaml.Node{}
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		if err == io.EOF {
+			// empty document
+			return nil
+		}
+
+		c.errors = append(c.errors, NewErrorf("Syntax error in %s: %s", path, err.Error()))
+		return nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		syntaxError(root, "Expected a map of settings")
+		return nil
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+
+		switch key.Value {
+		case "variables":
+			if node.Kind != yaml.MappingNode {
+				syntaxError(node, "Expected a map of variables")
+				continue
+			}
+
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				val, err := yamlValue("", node.Content[j+1])
+				if err != nil {
+					syntaxError(node.Content[j+1], "%s", err.Error())
+					continue
+				}
+
+				c.Variables[node.Content[j].Value] = val
+			}
+
+		case "include":
+			patterns := []*yaml.Node{node}
+			if node.Kind == yaml.SequenceNode {
+				patterns = node.Content
+			}
+
+			for _, p := range patterns {
+				pattern, err := yamlValue("", p)
+				if err != nil {
+					syntaxError(p, "%s", err.Error())
+					continue
+				}
+
+				if err := c.include(path, pattern, stack); err != nil {
+					c.errors = append(c.errors, err)
+				}
+			}
+
+		case "repos":
+			if node.Kind != yaml.MappingNode {
+				syntaxError(node, "Expected a map of repos")
+				continue
+			}
+
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				c.loadYAMLRepo(node.Content[j], node.Content[j+1], path)
+			}
+
+		default:
+			val, err := yamlValue(key.Value, node)
+			if err == nil {
+				err = c.setGlobal(key.Value, val)
+			}
+
+			if err != nil {
+				syntaxError(key, "%s", err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadYAMLRepo appends a repo defined in a YAML formatted Yumfile
+func (c *Yumfile) loadYAMLRepo(key *yaml.Node, node *yaml.Node, path string) {
+	repo := NewRepo()
+	repo.YumfilePath = path
+	repo.YumfileLineNo = key.Line
+	repo.ID = key.Value
+
+	if node.Kind != yaml.MappingNode {
+		c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: Expected a map of repo options", path, node.Line))
+	} else {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			opt := node.Content[i]
+			val, err := yamlValue(opt.Value, node.Content[i+1])
+			if err == nil {
+				err = c.setRepoOption(repo, opt.Value, val, path, opt.Line)
+			}
+
+			if err != nil {
+				c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: %s", path, opt.Line, err.Error()))
+			}
+		}
+	}
+
+	c.Repos = append(c.Repos, *repo)
+}
+
+// yamlValue returns the value of a scalar node, or the space separated values
+// of a list of scalars, with any environment variables expanded as for the
+// given key
+func yamlValue(key string, node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return expandValue(key, node.Value)
+
+	case yaml.SequenceNode:
+		vals := make([]string, 0)
+		for _, n := range node.Content {
+			if n.Kind != yaml.ScalarNode {
+				return "", NewErrorf("Expected a list of values")
+			}
+
+			vals = append(vals, n.Value)
+		}
+
+		return expandValue(key, strings.Join(vals, " "))
+	}
+
+	return "", NewErrorf("Expected a value or list of values")
+}
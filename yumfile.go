@@ -2,16 +2,47 @@ package main
 
 import (
 	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Yumfile struct {
 	Repos           []Repo
 	LocalPathPrefix string
+	Proxy           map[string]string
+	Variables       map[string]string
+	PostSync        string
+
+	// errors found while parsing
+	errors []error
+
+	// the first error which aborted a running sync
+	abortLock sync.Mutex
+	aborted   error
+
+	// package snapshots of the repos being downloaded, keyed by path
+	downloadLock sync.Mutex
+	downloads    map[string]map[string]os.FileInfo
+}
+
+// yumfileLine is a single line of a Yumfile
+type yumfileLine struct {
+	n    int    // line number
+	s    string // text
+	stop bool   // ends the current section
 }
 
 var boolMap = map[bool]int{
@@ -19,40 +50,182 @@ var boolMap = map[bool]int{
 	false: 0,
 }
 
+// checksumTypes maps checksum names and aliases to the algorithms
+// supported by createrepo
+var checksumTypes = map[string]string{
+	"md5":    "md5",
+	"sha":    "sha1",
+	"sha1":   "sha1",
+	"sha256": "sha256",
+	"sha512": "sha512",
+}
+
+// knownArches lists the package architectures which may be excluded from a
+// repo by an architecture filter. noarch packages are never excluded.
+var knownArches = []string{
+	"aarch64", "alpha", "amd64", "armv5tejl", "armv5tel", "armv6hl", "armv6l",
+	"armv7hl", "armv7hnl", "armv7l", "athlon", "geode", "i386", "i486", "i586",
+	"i686", "ia32e", "ia64", "pentium3", "pentium4", "ppc", "ppc64",
+	"ppc64iseries", "ppc64le", "ppc64p7", "ppc64pseries", "s390", "s390x",
+	"sparc", "sparc64", "sparcv9", "x86_64",
+}
+
+// archParents maps each package architecture to the next architecture in its
+// compatibility chain, as in yum's rpmUtils.arch. reposync --arch=ARCH fetches
+// packages of ARCH and every architecture in its chain.
+var archParents = map[string]string{
+	"aarch64":      "noarch",
+	"alpha":        "noarch",
+	"amd64":        "x86_64",
+	"armv5tejl":    "armv5tel",
+	"armv5tel":     "noarch",
+	"armv6hl":      "noarch",
+	"armv6l":       "armv5tejl",
+	"armv7hl":      "armv6hl",
+	"armv7hnl":     "armv7hl",
+	"armv7l":       "armv6l",
+	"athlon":       "i686",
+	"geode":        "i586",
+	"i386":         "noarch",
+	"i486":         "i386",
+	"i586":         "i486",
+	"i686":         "i586",
+	"ia32e":        "x86_64",
+	"ia64":         "noarch",
+	"pentium3":     "i686",
+	"pentium4":     "pentium3",
+	"ppc":          "noarch",
+	"ppc64":        "ppc",
+	"ppc64iseries": "ppc64",
+	"ppc64le":      "noarch",
+	"ppc64p7":      "ppc64",
+	"ppc64pseries": "ppc64",
+	"s390":         "noarch",
+	"s390x":        "s390",
+	"sparc":        "noarch",
+	"sparc64":      "sparcv9",
+	"sparcv9":      "sparc",
+	"x86_64":       "athlon",
+}
+
 var (
 	sectionHeadPattern = regexp.MustCompile("^\\[(.*)\\]")
 	keyValPattern      = regexp.MustCompile("^(\\w+)\\s*=\\s*(.*)")
 	commentPattern     = regexp.MustCompile("(^$)|(^\\s+$)|(^#)|(^;)")
+	byteSizePattern    = regexp.MustCompile("^(\\d+)\\s*([KMGT]?)B?$")
+	variableDefPattern = regexp.MustCompile("^\\$(\\w+)\\s*=\\s*(.*)")
+	variablePattern    = regexp.MustCompile("\\$(\\w+)")
+	includePattern     = regexp.MustCompile("^include\\s+(.+)")
+	envVarPattern      = regexp.MustCompile("\\$\\{(\\w+)\\}")
+	forPattern         = regexp.MustCompile("^for\\s+(\\w+)\\s+in\\s+(.+)")
+	endforPattern      = regexp.MustCompile("^endfor\\s*$")
 )
 
 // LoadYumfile loads a Yumfile from disk
 func LoadYumfile(path string) (*Yumfile, error) {
+	yumfile, err := ParseYumfile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// validate
+	if err := yumfile.Validate(); err != nil {
+		return nil, NewExitError(EXIT_CONFIG, err)
+	}
+
+	return yumfile, nil
+}
+
+// ParseYumfile loads a Yumfile from disk without validating it. Syntax errors
+// are collected and reported by Problems. An error is returned only if the
+// Yumfile cannot be read.
+func ParseYumfile(path string) (*Yumfile, error) {
+	yumfile := Yumfile{
+		Variables: make(map[string]string, 0),
+	}
+
+	if err := yumfile.load(path, nil); err != nil {
+		return nil, NewExitError(EXIT_CONFIG, err)
+	}
+
+	// substitute variables
+	yumfile.expandVariables()
+
+	// look up missing credentials
+	if err := yumfile.applyNetrc(); err != nil {
+		return nil, NewExitError(EXIT_CONFIG, err)
+	}
+
+	// append path prefix to each repo
+	if yumfile.LocalPathPrefix != "" {
+		for i, repo := range yumfile.Repos {
+			yumfile.Repos[i].LocalPath = filepath.Join(yumfile.LocalPathPrefix, repo.Path())
+		}
+	}
+
+	return &yumfile, nil
+}
+
+// load parses a Yumfile and appends its repos and settings to the Yumfile.
+// The stack lists the absolute paths of the files currently being loaded so
+// that circular includes can be detected.
+func (c *Yumfile) load(path string, stack []string) error {
 	Dprintf("Loading Yumfile: %s\n", path)
 
-	yumfile := Yumfile{}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	if containsString(stack, abs) {
+		return NewErrorf("Circular include of %s (from %s)", path, strings.Join(stack, " -> "))
+	}
+	stack = append(stack, abs)
 
 	// open file
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer f.Close()
 
-	// read each line
-	n := 0
+	if isYAML(path, len(stack) == 1) {
+		return c.loadYAML(f, path, stack)
+	}
+
+	// read all lines and expand loops
+	lines := make([]yumfileLine, 0)
 	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		lines = append(lines, yumfileLine{n: n, s: scanner.Text()})
+	}
+
+	// check for scan errors
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	lines, errs := expandLoops(lines, path)
+	c.errors = append(c.errors, errs...)
+
+	// parse each line
 	var repo *Repo = nil
-	for scanner.Scan() {
-		n++
-		s := scanner.Text()
+	for _, line := range lines {
+		n, s := line.n, line.s
 
-		if matches := sectionHeadPattern.FindAllStringSubmatch(s, -1); len(matches) > 0 {
+		if line.stop {
+			// loop boundaries end the current section
+			if repo != nil {
+				c.Repos = append(c.Repos, *repo)
+				repo = nil
+			}
+		} else if matches := sectionHeadPattern.FindAllStringSubmatch(s, -1); len(matches) > 0 {
 			// line is a [section header]
 			id := matches[0][1]
 
 			// append previous section
 			if repo != nil {
-				yumfile.Repos = append(yumfile.Repos, *repo)
+				c.Repos = append(c.Repos, *repo)
 			}
 
 			// create new repo def
@@ -61,165 +234,951 @@ func LoadYumfile(path string) (*Yumfile, error) {
 			repo.YumfilePath = path
 			repo.YumfileLineNo = n
 			repo.ID = id
+		} else if matches := variableDefPattern.FindAllStringSubmatch(s, -1); len(matches) > 0 {
+			// line is a $variable=value definition
+			if repo != nil {
+				c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: Variables must be defined before any repos", path, n))
+				continue
+			}
+
+			val, err := expandEnv(matches[0][2])
+			if err != nil {
+				c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: %s", path, n, err.Error()))
+				continue
+			}
+
+			c.Variables[matches[0][1]] = val
 		} else if matches := keyValPattern.FindAllStringSubmatch(s, -1); len(matches) > 0 {
 			// line is a key=val pair
 			key := matches[0][1]
-			val := matches[0][2]
+			val, err := expandValue(key, matches[0][2])
+			if err != nil {
+				c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: %s", path, n, err.Error()))
+				continue
+			}
 
 			if repo == nil {
 				// global key/val pair
-				switch key {
-				case "pathprefix":
-					yumfile.LocalPathPrefix = val
-
-				default:
-					return nil, NewErrorf("Syntax error in Yumfile on line %d: Unknown key: %s", n, key)
-				}
+				err = c.setGlobal(key, val)
 			} else {
 				// add key/val to current repo
-				switch key {
-				case "localpath":
-					repo.LocalPath = val
+				err = c.setRepoOption(repo, key, val, path, n)
+			}
 
-				case "arch":
-					repo.Architecture = val
+			if err != nil {
+				c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: %s", path, n, err.Error()))
+			}
+		} else if matches := includePattern.FindAllStringSubmatch(s, -1); len(matches) > 0 {
+			// line is an include directive which ends the current section
+			if repo != nil {
+				c.Repos = append(c.Repos, *repo)
+				repo = nil
+			}
 
-				case "newonly":
-					if b, err := strToBool(val); err != nil {
-						return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, err.Error())
-					} else {
-						repo.NewOnly = b
+			pattern, err := expandEnv(strings.TrimSpace(matches[0][1]))
+			if err != nil {
+				c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: %s", path, n, err.Error()))
+				continue
+			}
+
+			if err := c.include(path, pattern, stack); err != nil {
+				c.errors = append(c.errors, err)
+			}
+		} else if commentPattern.MatchString(s) {
+			// ignore line
+		} else {
+			c.errors = append(c.errors, NewErrorf("Syntax error in %s on line %d: %s", path, n, s))
+		}
+	}
+
+	// add last scanned repo
+	if repo != nil {
+		c.Repos = append(c.Repos, *repo)
+	}
+
+	return nil
+}
+
+// expandLoops replaces each for/endfor block in a Yumfile with a copy of its
+// lines for each value of the loop variable, with $variable substituted.
+// Loops may be nested.
+func expandLoops(lines []yumfileLine, path string) ([]yumfileLine, []error) {
+	out := make([]yumfileLine, 0, len(lines))
+	errs := make([]error, 0)
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if endforPattern.MatchString(line.s) {
+			errs = append(errs, NewErrorf("Syntax error in %s on line %d: endfor without for", path, line.n))
+			continue
+		}
+
+		matches := forPattern.FindAllStringSubmatch(line.s, -1)
+		if len(matches) == 0 {
+			out = append(out, line)
+			continue
+		}
+
+		// find the matching endfor
+		depth, end := 1, -1
+		for j := i + 1; j < len(lines) && end < 0; j++ {
+			if forPattern.MatchString(lines[j].s) {
+				depth++
+			} else if endforPattern.MatchString(lines[j].s) {
+				depth--
+				if depth == 0 {
+					end = j
+				}
+			}
+		}
+
+		if end < 0 {
+			errs = append(errs, NewErrorf("Syntax error in %s on line %d: for without endfor", path, line.n))
+			return out, errs
+		}
+
+		name := matches[0][1]
+		values, err := expandEnv(strings.Trim(strings.TrimSpace(matches[0][2]), "[]"))
+		if err != nil {
+			errs = append(errs, NewErrorf("Syntax error in %s on line %d: %s", path, line.n, err.Error()))
+		}
+
+		fields := strings.FieldsFunc(values, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) == 0 {
+			errs = append(errs, NewErrorf("Syntax error in %s on line %d: No values given for $%s", path, line.n, name))
+		}
+
+		body, berrs := expandLoops(lines[i+1:end], path)
+		errs = append(errs, berrs...)
+
+		for _, val := range fields {
+			out = append(out, yumfileLine{n: line.n, stop: true})
+			for _, b := range body {
+				b.s = variablePattern.ReplaceAllStringFunc(b.s, func(m string) string {
+					if m[1:] == name {
+						return val
 					}
 
-				case "sources":
-					if b, err := strToBool(val); err != nil {
-						return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, err.Error())
+					return m
+				})
+
+				out = append(out, b)
+			}
+		}
+		out = append(out, yumfileLine{n: lines[end].n, stop: true})
+
+		i = end
+	}
+
+	return out, errs
+}
+
+// setGlobal applies a global Yumfile setting
+func (c *Yumfile) setGlobal(key, val string) error {
+	switch key {
+	case "pathprefix":
+		c.LocalPathPrefix = val
+
+	case "postsync":
+		c.PostSync = val
+
+	case "proxy":
+		if params, err := proxyParameters(val); err != nil {
+			return err
+		} else {
+			c.Proxy = params
+		}
+
+	default:
+		return NewErrorf("Unknown key: %s", key)
+	}
+
+	return nil
+}
+
+// setRepoOption applies a setting to a repo. The path and line number of the
+// setting are used in warnings.
+func (c *Yumfile) setRepoOption(repo *Repo, key, val string, path string, n int) error {
+	switch key {
+	case "localpath":
+		repo.LocalPath = val
+
+	case "arch":
+		arches := strings.FieldsFunc(val, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(arches) == 0 {
+			return NewErrorf("No architecture specified")
+		}
+
+		arch, err := reposyncArch(arches)
+		if err != nil {
+			return err
+		}
+
+		repo.Architecture = arch
+		repo.Architectures = arches
+		if len(arches) > 1 {
+			// exclude all other known arches
+			for _, arch := range knownArches {
+				if !containsString(arches, arch) {
+					repo.AppendParameter("exclude", "*."+arch)
+				}
+			}
+		}
+
+	case "enabled":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.Enabled = b
+		}
+
+	case "newonly":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.NewOnly = b
+		}
+
+	case "sources":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.IncludeSources = b
+		}
+
+	case "deleteremoved":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.DeleteRemoved = b
+		}
+
+	case "gpgcheck":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.GPGCheck = b
+
+			// pass through to yum
+			repo.Parameters[key] = val
+		}
+
+	case "requiresigned":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.RequireSigned = b
+		}
+
+	case "failunsigned":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			// failing on unsigned packages implies checking for them
+			repo.FailUnsigned = b
+			if b {
+				repo.RequireSigned = true
+			}
+		}
+
+	case "repo_gpgcheck":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.RepoGPGCheck = b
+
+			// pass through to yum
+			repo.Parameters[key] = val
+		}
+
+	case "gpgkey":
+		// allow local paths as a shorthand for file:// URLs
+		keys := strings.Fields(val)
+		for i, k := range keys {
+			if strings.HasPrefix(k, "/") {
+				keys[i] = "file://" + k
+			}
+		}
+		repo.GPGKeys = keys
+
+		// pass through to yum
+		repo.Parameters[key] = strings.Join(keys, " ")
+
+	case "sslverify":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.SSLVerify = b
+			if !b {
+				Warnf("SSL certificate verification is disabled for '%s'. This is insecure! (in %s:%d)", repo.ID, path, n)
+			}
+
+			// pass through to yum
+			repo.Parameters[key] = val
+		}
+
+	case "sslcacert":
+		repo.SSLCACert = val
+
+		// pass through to yum
+		repo.Parameters[key] = val
+
+	case "sslclientcert":
+		repo.SSLClientCert = val
+
+		// pass through to yum
+		repo.Parameters[key] = val
+
+	case "sslclientkey":
+		repo.SSLClientKey = val
+
+		// pass through to yum
+		repo.Parameters[key] = val
+
+	case "exclude", "excludepkgs":
+		// excludepkgs is a dnf style alias for yum's exclude option
+		repo.AppendParameter("exclude", val)
+
+	case "baseurl":
+		// allow local paths as a shorthand for file:// URLs
+		urls := strings.Fields(val)
+		for i, u := range urls {
+			if strings.HasPrefix(u, "/") {
+				urls[i] = "file://" + u
+			}
+		}
+		repo.Parameters[key] = strings.Join(urls, " ")
+
+	case "checksum":
+		if sum, ok := checksumTypes[strings.ToLower(val)]; ok {
+			repo.Checksum = sum
+		} else {
+			Warnf("Unsupported checksum type '%s' for '%s' will be ignored (in %s:%d)", val, repo.ID, path, n)
+		}
+
+	case "groupfile":
+		repo.Groupfile = val
+
+	case "filemode", "dirmode":
+		mode, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || mode > 0777 {
+			return NewErrorf("Invalid file mode: %s", val)
+		}
+
+		if key == "filemode" {
+			repo.FileMode = os.FileMode(mode)
+		} else {
+			repo.DirMode = os.FileMode(mode)
+		}
+
+	case "owner":
+		if uid, gid, err := parseOwner(val); err != nil {
+			return err
+		} else {
+			repo.UID, repo.GID = uid, gid
+		}
+
+	case "postsync":
+		repo.PostSync = val
+
+	case "deltas":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			repo.Deltas = b
+		}
+
+	case "proxy":
+		if params, err := proxyParameters(val); err != nil {
+			return err
+		} else {
+			for k, v := range params {
+				repo.Parameters[k] = v
+			}
+		}
+
+	default:
+		repo.Parameters[key] = val
+	}
+
+	return nil
+}
+
+// include loads all Yumfiles matching a path or glob pattern in lexical
+// order. Relative paths are resolved against the directory of the including
+// Yumfile.
+func (c *Yumfile) include(parent string, pattern string, stack []string) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(parent), pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return NewErrorf("Invalid include pattern in %s: %s", parent, pattern)
+	}
+
+	// a literal path must exist
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return NewErrorf("Included Yumfile not found in %s: %s", parent, pattern)
+	}
+
+	for _, match := range matches {
+		if err := c.load(match, stack); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandVariables substitutes $variables in the URL and path fields of each
+// repo. Variables set on the command line take precedence over those defined
+// in the Yumfile. Undefined variables are left for yum to expand.
+func (c *Yumfile) expandVariables() {
+	vars := make(map[string]string, 0)
+	for k, v := range c.Variables {
+		vars[k] = v
+	}
+
+	if Releasever != "" {
+		vars["releasever"] = Releasever
+	}
+
+	if Basearch != "" {
+		vars["basearch"] = Basearch
+	}
+
+	if _, ok := vars["arch"]; !ok && vars["basearch"] != "" {
+		vars["arch"] = vars["basearch"]
+	}
+
+	expand := func(s string) string {
+		return variablePattern.ReplaceAllStringFunc(s, func(m string) string {
+			if val, ok := vars[m[1:]]; ok {
+				return val
+			}
+
+			return m
+		})
+	}
+
+	for i := range c.Repos {
+		repo := &c.Repos[i]
+		repo.LocalPath = expand(repo.LocalPath)
+		for _, key := range []string{"baseurl", "mirrorlist", "metalink", "gpgkey"} {
+			if val, ok := repo.Parameters[key]; ok {
+				repo.Parameters[key] = expand(val)
+			}
+		}
+
+		for j, key := range repo.GPGKeys {
+			repo.GPGKeys[j] = expand(key)
+		}
+	}
+}
+
+// Validate ensures all Yumfile fields contain valid values
+func (c *Yumfile) Validate() error {
+	if problems := c.Problems(); len(problems) > 0 {
+		return problems[0]
+	}
+
+	return nil
+}
+
+// Problems returns every syntax error and invalid value found in the Yumfile
+func (c *Yumfile) Problems() []error {
+	problems := make([]error, 0)
+	problems = append(problems, c.errors...)
+
+	ids := make(map[string]*Repo, 0)
+	paths := make(map[string]*Repo, 0)
+	for i, repo := range c.Repos {
+		problems = append(problems, repo.Problems()...)
+
+		if prev, ok := ids[repo.ID]; ok && repo.ID != "" {
+			problems = append(problems, NewErrorf("Duplicate repo ID '%s' (in %s:%d and %s:%d)", repo.ID, prev.YumfilePath, prev.YumfileLineNo, repo.YumfilePath, repo.YumfileLineNo))
+		} else {
+			ids[repo.ID] = &c.Repos[i]
+		}
+
+		path := filepath.Clean(repo.Path())
+		if prev, ok := paths[path]; ok {
+			problems = append(problems, NewErrorf("Repos '%s' and '%s' share the same local path: %s (in %s:%d)", prev.ID, repo.ID, path, repo.YumfilePath, repo.YumfileLineNo))
+		} else {
+			paths[path] = &c.Repos[i]
+		}
+	}
+
+	return problems
+}
+
+// PathProblems returns an error for each local path that y10k would be
+// unable to write to when syncronizing the Yumfile
+func (c *Yumfile) PathProblems() []error {
+	problems := make([]error, 0)
+
+	if err := checkWritable(TmpBasePath); err != nil {
+		problems = append(problems, NewErrorf("Temporary path is not writable: %s", err.Error()))
+	}
+
+	for _, repo := range c.Repos {
+		if err := checkWritable(repo.Path()); err != nil {
+			problems = append(problems, NewErrorf("Local path for '%s' is not writable: %s (in %s:%d)", repo.ID, err.Error(), repo.YumfilePath, repo.YumfileLineNo))
+		}
+	}
+
+	return problems
+}
+
+func (c *Yumfile) GetRepoByID(id string) *Repo {
+	for _, repo := range c.Repos {
+		if repo.ID == id {
+			return &repo
+		}
+	}
+
+	return nil
+}
+
+// SelectRepos returns the repos with the given IDs, or all enabled repos if
+// no IDs are given, less any excluded repos. Repos selected by ID are
+// returned even if they are disabled.
+func (c *Yumfile) SelectRepos(ids []string, exclude []string) ([]Repo, error) {
+	for _, id := range append(ids, exclude...) {
+		if c.GetRepoByID(id) == nil {
+			return nil, NewErrorf("No such repo found in Yumfile: %s", id)
+		}
+	}
+
+	repos := make([]Repo, 0)
+	for _, repo := range c.Repos {
+		switch {
+		case containsString(exclude, repo.ID):
+			Printf("Skipping excluded repo: %s\n", repo.ID)
+
+		case len(ids) > 0:
+			if containsString(ids, repo.ID) {
+				repos = append(repos, repo)
+			}
+
+		case !repo.Enabled:
+			Printf("Skipping disabled repo: %s\n", repo.ID)
+
+		default:
+			repos = append(repos, repo)
+		}
+	}
+
+	return repos, nil
+}
+
+func (c *Yumfile) SyncAll() ([]RepoStats, error) {
+	return c.Sync(c.Repos)
+}
+
+// Sync processes all repository mirrors defined in a Yumfile. Up to
+// RepoConcurrency repos are syncronized in parallel. A failure in one repo
+// does not prevent the remaining repos from being syncronized. The outcome of
+// each repo is returned in the same order as the given repos.
+func (c *Yumfile) Sync(repos []Repo) ([]RepoStats, error) {
+	//if err := c.installYumConf(repos); err != nil {
+	//	return err
+	//}
+
+	concurrency := RepoConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := 0
+	downloaded := int64(0)
+	codes := make(map[int]bool, 0)
+	stats := make([]RepoStats, len(repos))
+	ch := make(chan int)
+
+	// abort the run if disk space runs low or too much has been downloaded
+	done := make(chan bool)
+	if MinFreeSpace > 0 || MaxDownloadSize > 0 {
+		go func() {
+			ticker := time.NewTicker(10 * time.Second)
+			defer ticker.Stop()
+			for tick := 1; ; tick++ {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					for _, repo := range repos {
+						if err := checkFreeSpace(repo.Path()); err != nil {
+							c.abort(NewExitError(EXIT_DISK, err))
+						}
+					}
+
+					// unfinished downloads are measured less often, as
+					// each mirror must be listed
+					if MaxDownloadSize > 0 && tick%3 == 0 {
+						mu.Lock()
+						total := downloaded
+						mu.Unlock()
+
+						total += c.downloadingBytes()
+						if total > MaxDownloadSize {
+							c.abort(maxDownloadSizeError(total))
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				repo := repos[i]
+				if SyncWindow != nil {
+					SyncWindow.Wait(repo.ID)
+				}
+
+				start := time.Now()
+				before := snapshotPackages(repo.Path())
+
+				emitEvent("start", map[string]interface{}{
+					"repo": repo.ID,
+					"path": repo.Path(),
+				})
+
+				err := checkFreeSpace(repo.Path())
+				if err != nil {
+					c.abort(NewExitError(EXIT_DISK, err))
+				}
+
+				if aborted := c.abortErr(); aborted != nil {
+					err = aborted
+				}
+
+				attempts := 0
+				if err == nil {
+					if Staging && !DryRun {
+						attempts, err = c.syncStaged(&repo, before)
 					} else {
-						repo.IncludeSources = b
+						attempts, err = c.syncRepo(&repo, before)
+					}
+				} else {
+					Errorf(nil, "Skipping repo: %s", repo.ID)
+				}
+
+				if err == nil && repo.PostSync != "" && !DryRun {
+					env := []string{
+						"Y10K_REPO_ID=" + repo.ID,
+						"Y10K_REPO_PATH=" + repo.Path(),
+					}
+
+					if err = c.runHook(repo.ID, repo.PostSync, env); err != nil {
+						Errorf(err, "Post-sync command failed for %s", repo.ID)
 					}
+				}
+
+				stats[i] = NewRepoStats(&repo, before, snapshotPackages(repo.Path()), time.Since(start), attempts, err)
+				if err != nil {
+					emitEvent("error", map[string]interface{}{
+						"repo":     repo.ID,
+						"error":    err.Error(),
+						"attempts": stats[i].Attempts,
+					})
+				} else {
+					emitEvent("done", map[string]interface{}{
+						"repo":            repo.ID,
+						"downloaded":      stats[i].Downloaded,
+						"deleted":         stats[i].Deleted,
+						"bytes":           stats[i].Bytes,
+						"elapsed_seconds": stats[i].Elapsed,
+						"attempts":        stats[i].Attempts,
+					})
+				}
+				mu.Lock()
+				downloaded += stats[i].Bytes
+				total := downloaded
+				if err != nil {
+					failed++
+					codes[exitCode(err)] = true
+				}
+				mu.Unlock()
+
+				if MaxDownloadSize > 0 && total > MaxDownloadSize {
+					c.abort(maxDownloadSizeError(total))
+				}
+			}
+		}()
+	}
+
+	for i := range repos {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	close(done)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if failed > 0 {
+		Errorf(nil, "The following repos failed to syncronize:")
+		for _, s := range stats {
+			if s.Error != "" {
+				Errorf(nil, "  %s: %s", s.ID, s.Error)
+			}
+		}
+	}
+
+	if aborted := c.abortErr(); aborted != nil {
+		return stats, aborted
+	}
+
+	if failed > 0 {
+		// exit with the cause of failure if all repos failed for the same
+		// reason
+		code := EXIT_PARTIAL
+		if failed == len(repos) {
+			code = EXIT_ERROR
+			if len(codes) == 1 {
+				for k := range codes {
+					code = k
+				}
+			}
+		}
+
+		return stats, NewExitError(code, NewErrorf("%d of %d repos failed to syncronize", failed, len(repos)))
+	}
+
+	// run global hook once all repos are syncronized
+	if c.PostSync != "" && !DryRun {
+		ids := make([]string, len(repos))
+		for i, repo := range repos {
+			ids[i] = repo.ID
+		}
+
+		if err := c.runHook("Yumfile", c.PostSync, []string{"Y10K_REPOS=" + strings.Join(ids, " ")}); err != nil {
+			return stats, NewErrorf("Post-sync command failed: %s", err.Error())
+		}
+	}
+
+	return stats, nil
+}
+
+// abort stops a running sync. Running child processes are terminated, repos
+// which have not started are skipped and failed downloads are not retried.
+// Only the first error is kept.
+func (c *Yumfile) abort(err error) {
+	c.abortLock.Lock()
+	defer c.abortLock.Unlock()
+	if c.aborted == nil {
+		Errorf(err, "Aborting sync")
+		c.aborted = err
+		KillChildren()
+	}
+}
+
+// maxDownloadSizeError returns the error which aborts a sync that has
+// downloaded more than MaxDownloadSize bytes
+func maxDownloadSizeError(total int64) error {
+	return NewErrorf("Downloaded %s which exceeds the maximum download size of %s", bytesToStr(total), bytesToStr(MaxDownloadSize))
+}
+
+// trackDownload records the package snapshot of a repo while reposync runs
+// so that the size of an unfinished download can be measured. The repo is no
+// longer tracked once the returned function is called.
+func (c *Yumfile) trackDownload(repo *Repo, before map[string]os.FileInfo) func() {
+	path := repo.Path()
+
+	c.downloadLock.Lock()
+	defer c.downloadLock.Unlock()
+	if c.downloads == nil {
+		c.downloads = make(map[string]map[string]os.FileInfo, 0)
+	}
+	c.downloads[path] = before
+
+	return func() {
+		c.downloadLock.Lock()
+		defer c.downloadLock.Unlock()
+		delete(c.downloads, path)
+	}
+}
+
+// downloadingBytes returns the size of the packages downloaded so far by each
+// running reposync. Packages replaced in place are counted once their repo
+// finishes.
+func (c *Yumfile) downloadingBytes() int64 {
+	c.downloadLock.Lock()
+	downloads := make(map[string]map[string]os.FileInfo, len(c.downloads))
+	for path, before := range c.downloads {
+		downloads[path] = before
+	}
+	c.downloadLock.Unlock()
+
+	total := int64(0)
+	for path, before := range downloads {
+		total += newPackageBytes(path, before)
+	}
+
+	return total
+}
 
-				case "deleteremoved":
-					if b, err := strToBool(val); err != nil {
-						return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, err.Error())
-					} else {
-						repo.DeleteRemoved = b
-					}
+// newPackageBytes returns the total size of the package files found in the
+// given path which are not in the given snapshot. Only directories and new
+// packages are stat'ed, so that large mirrors can be polled cheaply while they
+// are syncronized.
+func newPackageBytes(path string, before map[string]os.FileInfo) int64 {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
 
-				case "gpgcheck":
-					if b, err := strToBool(val); err != nil {
-						return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, err.Error())
-					} else {
-						repo.GPGCheck = b
+	total := int64(0)
+	var walk func(dir, rel string)
+	walk = func(dir, rel string) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return
+		}
+		names, _ := f.Readdirnames(-1)
+		f.Close()
 
-						// pass through to yum
-						repo.Parameters[key] = val
-					}
+		for _, name := range names {
+			if _, ok := before[filepath.Join(rel, name)]; ok {
+				continue
+			}
 
-				case "checksum":
-					repo.Checksum = val
+			fi, err := os.Lstat(filepath.Join(dir, name))
+			switch {
+			case err != nil:
+				// removed since it was listed
 
-				case "groupfile":
-					repo.Groupfile = val
+			case fi.IsDir():
+				walk(filepath.Join(dir, name), filepath.Join(rel, name))
 
-				default:
-					repo.Parameters[key] = val
-				}
+			case strings.HasSuffix(name, ".rpm"):
+				total += fi.Size()
 			}
-		} else if commentPattern.MatchString(s) {
-			// ignore line
-		} else {
-			return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, s)
 		}
 	}
+	walk(path, "")
 
-	// add last scanned repo
-	if repo != nil {
-		yumfile.Repos = append(yumfile.Repos, *repo)
-	}
+	return total
+}
 
-	// check for scan errors
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
+// abortErr returns the error which aborted the running sync, if any
+func (c *Yumfile) abortErr() error {
+	c.abortLock.Lock()
+	defer c.abortLock.Unlock()
+	return c.aborted
+}
 
-	// validate
-	if err = yumfile.Validate(); err != nil {
-		return nil, err
-	}
+// runHook executes a post-sync command with the shell. The path of the
+// Yumfile and the given variables are added to its environment. Output of the
+// command is printed, prefixed with the given label.
+func (c *Yumfile) runHook(label, command string, env []string) error {
+	Printf("Running post-sync command for %s\n", label)
 
-	return &yumfile, nil
+	env = append(env, "Y10K_YUMFILE="+YumfilePath)
+	return ExecLinesEnv(label, env, func(line string) {
+		Printf("%s: %s\n", label, line)
+	}, "/bin/sh", "-c", command)
 }
 
-// Validate ensures all Yumfile fields contain valid values
-func (c *Yumfile) Validate() error {
-	for i, repo := range c.Repos {
-		if err := repo.Validate(); err != nil {
-			return err
-		}
-
-		// append path prefix to each repo
-		if c.LocalPathPrefix != "" {
-			c.Repos[i].LocalPath = fmt.Sprintf("%s/%s", c.LocalPathPrefix, repo.LocalPath)
-		}
+// syncRepo syncronizes a single repo mirror and updates its database. The
+// given snapshot of the repo's packages is used to find the packages
+// downloaded by this sync. Errors are logged as they occur and the first error is
+// returned, along with the number of times reposync was run.
+func (c *Yumfile) syncRepo(repo *Repo, before map[string]os.FileInfo) (int, error) {
+	if err := c.installYumConf(repo); err != nil {
+		Errorf(err, "Failed to create yum.conf for %s", repo.ID)
+		return 0, NewExitError(EXIT_DISK, err)
+	}
 
-		// TODO: Prevent duplicate local paths and repo IDs
+	untrack := c.trackDownload(repo, before)
+	attempts, err := c.reposync(repo)
+	untrack()
+	if aborted := c.abortErr(); aborted != nil {
+		return attempts, aborted
+	}
+	if err != nil {
+		Errorf(err, "Failed to download updates for %s", repo.ID)
+		return attempts, NewExitError(EXIT_NETWORK, err)
 	}
 
-	return nil
-}
+	// no changes to the repo database
+	if DryRun {
+		return attempts, nil
+	}
 
-func (c *Yumfile) GetRepoByID(id string) *Repo {
-	for _, repo := range c.Repos {
-		if repo.ID == id {
-			return &repo
+	if repo.RequireSigned {
+		if err := c.checkSignatures(repo); err != nil {
+			Errorf(err, "Signature check failed for %s", repo.ID)
+			return attempts, NewExitError(EXIT_VERIFY, err)
 		}
 	}
 
-	return nil
-}
+	if !c.needsCreaterepo(repo) {
+		Printf("Repo database is up to date: %s\n", repo.ID)
+	} else {
+		if err := c.createrepo(repo, true); err != nil {
+			Errorf(err, "Failed to update repo database for %s", repo.ID)
+			return attempts, err
+		}
 
-func (c *Yumfile) SyncAll() error {
-	return c.Sync(c.Repos)
-}
+		if err := c.modifyrepo(repo); err != nil {
+			Errorf(err, "Failed to add module metadata to repo database for %s", repo.ID)
+			return attempts, err
+		}
+	}
 
-// Sync processes all repository mirrors defined in a Yumfile
-func (c *Yumfile) Sync(repos []Repo) error {
-	//if err := c.installYumConf(repos); err != nil {
-	//	return err
-	//}
+	if err := c.applyPermissions(repo); err != nil {
+		Errorf(err, "Failed to set permissions for %s", repo.ID)
+		return attempts, NewExitError(EXIT_DISK, err)
+	}
 
-	for _, repo := range repos {
-		if err := c.installYumConf(&repo); err != nil {
-			Errorf(err, "Failed to create yum.conf for %s", repo.ID)
-		} else {
-			if err := c.reposync(&repo); err != nil {
-				Errorf(err, "Failed to download updates for %s", repo.ID)
-			} else {
-				if err := c.createrepo(&repo); err != nil {
-					Errorf(err, "Failed to update repo database for %s", repo.ID)
-				}
-			}
+	if ManifestDir != "" {
+		if err := c.writeManifest(repo); err != nil {
+			Errorf(err, "Failed to write package manifest for %s", repo.ID)
+			return attempts, NewExitError(EXIT_DISK, err)
 		}
 	}
 
-	return nil
+	return attempts, nil
+}
+
+// yumConfPath returns the path of the temporary yum.conf file for a repo
+func (c *Yumfile) yumConfPath(repo *Repo) string {
+	return filepath.Join(TmpBasePath, fmt.Sprintf("yum-%s.conf", repo.ID))
 }
 
 func (c *Yumfile) installYumConf(repo *Repo) error {
-	Dprintf("Installing yum.conf file: %s\n", TmpYumConfPath)
+	path := c.yumConfPath(repo)
+	Dprintf("Installing yum.conf file: %s\n", path)
 
 	// create temp path
 	if err := os.MkdirAll(TmpBasePath, 0750); err != nil {
 		return err
 	}
 
-	// create config file
-	f, err := os.Create(TmpYumConfPath)
+	// create config file (readable only by owner as it may contain credentials)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	if err := f.Chmod(0600); err != nil {
+		return err
+	}
+
 	// global yum conf
 	fmt.Fprintf(f, "[main]\n")
 	fmt.Fprintf(f, "cachedir=%s\n", TmpYumCachePath)
@@ -231,25 +1190,58 @@ func (c *Yumfile) installYumConf(repo *Repo) error {
 	fmt.Fprintf(f, "plugins=0\n")
 	fmt.Fprintf(f, "reposdir=\n")
 	fmt.Fprintf(f, "rpmverbosity=debug\n")
-	fmt.Fprintf(f, "timeout=5\n")
+	if DownloadRateLimit > 0 {
+		// share the rate limit between repos syncronized in parallel
+		throttle := DownloadRateLimit
+		if RepoConcurrency > 1 {
+			throttle /= int64(RepoConcurrency)
+		}
+		if throttle < 1 {
+			throttle = 1
+		}
+
+		fmt.Fprintf(f, "throttle=%d\n", throttle)
+	}
+	for _, key := range []string{"proxy", "proxy_username", "proxy_password"} {
+		if val, ok := c.Proxy[key]; ok {
+			fmt.Fprintf(f, "%s=%s\n", key, val)
+		}
+	}
+	fmt.Fprintf(f, "timeout=%d\n", DownloadTimeout)
+	if repo.RepoGPGCheck {
+		// import the repo's gpgkey without prompting so yum can verify the
+		// signature of repomd.xml. Imported keys are kept in the cache.
+		fmt.Fprintf(f, "assumeyes=1\n")
+	}
+	if DownloadMinRate > 0 {
+		fmt.Fprintf(f, "minrate=%d\n", DownloadMinRate)
+	}
 	fmt.Fprintf(f, "\n")
 
-	// append repo config
+	// append repo config in a stable order so that runs may be compared
 	fmt.Fprintf(f, "[%s]\n", repo.ID)
-	for key, val := range repo.Parameters {
-		fmt.Fprintf(f, "%s=%s\n", key, val)
+	keys := make([]string, 0, len(repo.Parameters))
+	for key := range repo.Parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(f, "%s=%s\n", key, repo.Parameters[key])
 	}
 	fmt.Fprintf(f, "\n")
 
 	return nil
 }
 
-func (c *Yumfile) reposync(repo *Repo) error {
+// reposync downloads new packages for a repo, retrying failures up to
+// DownloadRetries times, and returns the number of attempts made
+func (c *Yumfile) reposync(repo *Repo) (int, error) {
 	Printf("Syncronizing repo: %s\n", repo.ID)
 
 	// compute args for reposync command
 	args := []string{
-		fmt.Sprintf("--config=%s", TmpYumConfPath),
+		fmt.Sprintf("--config=%s", c.yumConfPath(repo)),
 		fmt.Sprintf("--repoid=%s", repo.ID),
 		"--norepopath",
 		"--downloadcomps",
@@ -268,8 +1260,14 @@ func (c *Yumfile) reposync(repo *Repo) error {
 		args = append(args, "--source")
 	}
 
-	if repo.DeleteRemoved {
-		args = append(args, "--delete")
+	// reposync deletes packages even when only listing urls, so never pass
+	// --delete in dry-run mode
+	if repo.DeleteRemoved || DeleteRemoved {
+		if DryRun {
+			Printf("Packages removed upstream will not be deleted in dry-run mode\n")
+		} else {
+			args = append(args, "--delete")
+		}
 	}
 
 	if repo.GPGCheck {
@@ -280,29 +1278,209 @@ func (c *Yumfile) reposync(repo *Repo) error {
 		args = append(args, fmt.Sprintf("--arch=%s", repo.Architecture))
 	}
 
-	if repo.LocalPath != "" {
-		args = append(args, fmt.Sprintf("--download_path=%s", repo.LocalPath))
-	} else {
-		args = append(args, fmt.Sprintf("--download_path=./%s", repo.ID))
+	args = append(args, fmt.Sprintf("--download_path=%s", repo.Path()))
+
+	// list what would be downloaded instead of downloading it
+	var handler func(string) = nil
+	if DryRun {
+		args = append(args, "--urls")
+		handler = func(line string) {
+			Outputf("Would download: %s\n", line)
+		}
 	}
 
-	// execute and capture output
-	if err := Exec("reposync", args...); err != nil {
+	// trace each request made by urlgrabber (DNS, connect, TLS and transfer
+	// output from curl) to STDERR, which is redirected to debug. Credentials
+	// in the traced headers are redacted by ExecLines.
+	var env []string = nil
+	if DebugMode {
+		env = []string{"URLGRABBER_DEBUG=DEBUG"}
+	}
+
+	// limit the connections made to each upstream host
+	release := acquireHost(repo)
+	defer release()
+
+	// execute and capture output, retrying with exponential backoff
+	var err error = nil
+	for attempt := 0; attempt <= DownloadRetries; attempt++ {
+		// a reposync killed by an aborted sync is not retried
+		if aborted := c.abortErr(); aborted != nil {
+			return attempt, aborted
+		}
+
+		if attempt > 0 {
+			delay := time.Duration(1<<uint(attempt-1)) * time.Second
+			Dprintf("reposync failed for %s (%s). Retrying in %s (attempt %d of %d)...\n", repo.ID, err.Error(), delay, attempt, DownloadRetries)
+			time.Sleep(delay)
+		}
+
+		if err = ExecLinesEnv(repo.ID, env, handler, "reposync", args...); err == nil {
+			return attempt + 1, nil
+		}
+	}
+
+	return DownloadRetries + 1, err
+}
+
+// needsCreaterepo returns true if the packages in a repo differ from those
+// indexed in its database, or if the repo has no database yet. The database
+// is compared with the packages on disk, rather than with those present before
+// the sync, so that packages downloaded by an earlier sync which failed before
+// its database was updated are added by the next.
+func (c *Yumfile) needsCreaterepo(repo *Repo) bool {
+	repomd, err := os.Stat(filepath.Join(repo.Path(), "repodata", "repomd.xml"))
+	if err != nil {
+		return true
+	}
+
+	// group or module metadata updated since the database was created
+	for _, path := range []string{c.groupfile(repo), c.modulesfile(repo)} {
+		if path != "" {
+			if fi, err := os.Stat(path); err == nil && fi.ModTime().After(repomd.ModTime()) {
+				return true
+			}
+		}
+	}
+
+	// packages added or replaced since the database was created
+	packages := snapshotPackages(repo.Path())
+	for _, fi := range packages {
+		if fi.ModTime().After(repomd.ModTime()) {
+			return true
+		}
+	}
+
+	// packages added or removed without changing their modification time
+	indexed := 0
+	err = WalkPackages(repo.Path(), func(pkg *Package) error {
+		if _, ok := packages[filepath.FromSlash(pkg.Location.Href)]; !ok {
+			return NewErrorf("Indexed package not found: %s", pkg.Location.Href)
+		}
+
+		indexed++
+		return nil
+	})
+	if err != nil {
+		Dprintf("Repo database for %s is out of date: %s\n", repo.ID, err.Error())
+		return true
+	}
+
+	return indexed != len(packages)
+}
+
+// groupfile returns the path of the group (comps) metadata for a repo. If no
+// groupfile is configured, the comps.xml downloaded by reposync is used.
+func (c *Yumfile) groupfile(repo *Repo) string {
+	if repo.Groupfile != "" {
+		return repo.Groupfile
+	}
+
+	path := filepath.Join(repo.Path(), "comps.xml")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+
+	return ""
+}
+
+// modulesfile returns the path of the newest module metadata document
+// downloaded by reposync for a repo, if any
+func (c *Yumfile) modulesfile(repo *Repo) string {
+	matches, _ := filepath.Glob(filepath.Join(repo.Path(), "*modules.yaml*"))
+
+	path := ""
+	var mtime time.Time
+	for _, match := range matches {
+		if fi, err := os.Stat(match); err == nil && fi.ModTime().After(mtime) {
+			path = match
+			mtime = fi.ModTime()
+		}
+	}
+
+	return path
+}
+
+// modifyrepo adds the upstream module metadata to the repo database created
+// by createrepo
+func (c *Yumfile) modifyrepo(repo *Repo) error {
+	path := c.modulesfile(repo)
+	if path == "" {
+		return nil
+	}
+
+	Printf("Adding module metadata to repo database: %s\n", repo.ID)
+
+	// modifyrepo compresses the document itself, so decompress it first
+	src, err := os.Open(path)
+	if err != nil {
 		return err
 	}
+	defer src.Close()
 
-	return nil
+	var r io.Reader = src
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(src)
+
+	case strings.HasSuffix(path, ".yaml"):
+		// uncompressed
+
+	default:
+		return NewErrorf("Unsupported module metadata compression: %s", path)
+	}
+
+	if err := os.MkdirAll(TmpBasePath, 0750); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(TmpBasePath, fmt.Sprintf("modules-%s.yaml", repo.ID))
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(dst, r)
+	dst.Close()
+	if err != nil {
+		return err
+	}
+
+	return ExecLines(repo.ID, nil, "modifyrepo", "--mdtype=modules", tmp, filepath.Join(repo.Path(), "repodata"))
 }
 
-func (c *Yumfile) createrepo(repo *Repo) error {
+// createrepo creates or updates the database of a repo. If update is true,
+// the metadata of packages which have not changed since the database was
+// last created is reused. Otherwise all packages are read again.
+func (c *Yumfile) createrepo(repo *Repo, update bool) error {
 	Printf("Updating repo database: %s\n", repo.ID)
 
+	// share worker threads between repos syncronized in parallel
+	workers := runtime.NumCPU() * 2
+	if RepoConcurrency > 1 {
+		workers /= RepoConcurrency
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
 	// compute args for createrepo command
 	args := []string{
-		"--update",
 		"--database",
-		"--checkts",
-		fmt.Sprintf("--workers=%d", runtime.NumCPU()*2),
+		fmt.Sprintf("--workers=%d", workers),
+	}
+
+	if update {
+		args = append(args, "--update", "--checkts")
 	}
 
 	if QuietMode {
@@ -316,8 +1494,13 @@ func (c *Yumfile) createrepo(repo *Repo) error {
 		args = append(args, "--verbose")
 	}
 
-	if repo.Groupfile != "" {
-		args = append(args, fmt.Sprintf("--groupfile=%s", repo.Groupfile))
+	if groupfile := c.groupfile(repo); groupfile != "" {
+		args = append(args, fmt.Sprintf("--groupfile=%s", groupfile))
+	}
+
+	// generate deltarpms between package versions
+	if repo.Deltas {
+		args = append(args, "--deltas")
 	}
 
 	// non-default checksum type
@@ -326,20 +1509,80 @@ func (c *Yumfile) createrepo(repo *Repo) error {
 	}
 
 	// path to create repo for
-	if repo.LocalPath != "" {
-		args = append(args, repo.LocalPath)
-	} else {
-		args = append(args, fmt.Sprintf("./%s", repo.ID))
-	}
+	args = append(args, repo.Path())
 
 	// execute and capture output
-	if err := Exec("createrepo", args...); err != nil {
+	if err := ExecLines(repo.ID, nil, "createrepo", args...); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// expandEnv substitutes ${NAME} references in a Yumfile value with the value
+// of the named environment variable. An unset variable is an error.
+func expandEnv(s string) (string, error) {
+	var err error = nil
+	s = envVarPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[2 : len(m)-1]
+
+		// os.LookupEnv is not available in Go 1.4
+		val, ok := syscall.Getenv(name)
+		if !ok && err == nil {
+			err = NewErrorf("Environment variable is not set: %s", name)
+		}
+
+		return val
+	})
+
+	return s, err
+}
+
+// expandValue substitutes ${NAME} references in the value of a Yumfile key.
+// postsync commands are run by the shell, which expands their variables, so
+// they are left as is. The $Y10K_* variables a command may use are only set
+// when it runs.
+func expandValue(key, s string) (string, error) {
+	if key == "postsync" {
+		return s, nil
+	}
+
+	return expandEnv(s)
+}
+
+// proxyParameters converts a proxy URL into yum proxy settings, splitting out
+// any embedded credentials into proxy_username and proxy_password
+func proxyParameters(s string) (map[string]string, error) {
+	params := map[string]string{
+		"proxy": s,
+	}
+
+	if s == "_none_" {
+		return params, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, NewErrorf("Invalid proxy URL: %s", s)
+	}
+
+	if u.User != nil {
+		params["proxy_username"] = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			params["proxy_password"] = password
+		}
+
+		u.User = nil
+		params["proxy"] = u.String()
+	}
+
+	return params, nil
+}
+
 func strToBool(s string) (bool, error) {
 	lc := strings.ToLower(s)
 
@@ -353,3 +1596,174 @@ func strToBool(s string) (bool, error) {
 
 	return false, NewErrorf("Invalid boolean value: %s", s)
 }
+
+func strToBytes(s string) (int64, error) {
+	matches := byteSizePattern.FindAllStringSubmatch(strings.ToUpper(s), -1)
+	if len(matches) == 0 {
+		return 0, NewErrorf("Invalid byte size: %s", s)
+	}
+
+	n, err := strconv.ParseInt(matches[0][1], 10, 64)
+	if err != nil {
+		return 0, NewErrorf("Invalid byte size: %s", s)
+	}
+
+	switch matches[0][2] {
+	case "K":
+		n *= 1 << 10
+	case "M":
+		n *= 1 << 20
+	case "G":
+		n *= 1 << 30
+	case "T":
+		n *= 1 << 40
+	}
+
+	return n, nil
+}
+
+// checkWritable returns an error if files cannot be created in the given
+// directory or, if it does not exist yet, in its nearest existing parent
+func checkWritable(path string) error {
+	dir, err := existingDir(path)
+	if err != nil {
+		return err
+	}
+
+	if !isWritable(dir) {
+		return NewErrorf("%s permission denied", dir)
+	}
+
+	return nil
+}
+
+// checkFreeSpace returns an error if the filesystem which holds the given path
+// (or its nearest existing parent) has less than MinFreeSpace bytes available
+func checkFreeSpace(path string) error {
+	if MinFreeSpace <= 0 {
+		return nil
+	}
+
+	dir, err := existingDir(path)
+	if err != nil {
+		return err
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+
+	if free < MinFreeSpace {
+		return NewErrorf("Only %s available on the filesystem of %s (minimum is %s)", bytesToStr(free), dir, bytesToStr(MinFreeSpace))
+	}
+
+	return nil
+}
+
+// existingDir returns the given path if it exists, otherwise its nearest
+// existing parent directory
+func existingDir(path string) (string, error) {
+	dir := path
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return "", NewErrorf("%s is not a directory", dir)
+			}
+
+			return dir, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			return "", err
+		}
+
+		dir = parent
+	}
+}
+
+// bytesToStr formats a byte size using the largest whole unit accepted by
+// strToBytes
+func bytesToStr(n int64) string {
+	units := []string{"TB", "GB", "MB", "KB"}
+	for i, unit := range units {
+		size := int64(1) << uint(10*(len(units)-i))
+		if n >= size {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(size), unit)
+		}
+	}
+
+	return fmt.Sprintf("%dB", n)
+}
+
+// reposyncArch returns the architecture to pass to reposync --arch so that
+// packages of all the given architectures are fetched. It is the given
+// architecture whose compatibility chain includes all the others. noarch and
+// src packages are always fetched.
+func reposyncArch(arches []string) (string, error) {
+	others := make([]string, 0)
+	for _, arch := range arches {
+		if arch != "noarch" && arch != "src" {
+			others = append(others, arch)
+		}
+	}
+
+	if len(others) == 0 {
+		return arches[0], nil
+	}
+
+	for _, arch := range others {
+		chain := []string{}
+		for a := arch; a != ""; a = archParents[a] {
+			chain = append(chain, a)
+		}
+
+		covered := true
+		for _, other := range others {
+			if !containsString(chain, other) {
+				covered = false
+			}
+		}
+
+		if covered {
+			return arch, nil
+		}
+	}
+
+	return "", NewErrorf("Architectures %s cannot be mirrored by a single repo (use a separate repo for each)", strings.Join(others, ", "))
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// snapshotPackages returns the file info of every package file found in the
+// given path, keyed by file path relative to the given path
+func snapshotPackages(path string) map[string]os.FileInfo {
+	packages := make(map[string]os.FileInfo, 0)
+
+	// walk the target of a symlinked mirror
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+
+	filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && strings.HasSuffix(p, ".rpm") {
+			if rel, err := filepath.Rel(path, p); err == nil {
+				packages[rel] = fi
+			}
+		}
+
+		return nil
+	})
+
+	return packages
+}